@@ -8,10 +8,13 @@ import (
 	"os/signal"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-sigs/minibroker/pkg/broker"
+	"github.com/kubernetes-sigs/minibroker/pkg/helm"
 	"github.com/pmorie/osb-broker-lib/pkg/metrics"
 	prom "github.com/prometheus/client_golang/prometheus"
 
@@ -22,9 +25,11 @@ import (
 var options struct {
 	broker.Options
 
-	Port    int
-	TLSCert string
-	TLSKey  string
+	Port              int
+	TLSCert           string
+	TLSKey            string
+	AuthTokenUsers    string
+	AllowedNamespaces string
 }
 
 func init() {
@@ -37,11 +42,55 @@ func init() {
 	flag.StringVar(&options.TLSKey, "tlsKey", "",
 		"base-64 encoded PEM block to use as the private key matching the TLS certificate. If '--tlsKey' is used, then '--tlsCert' must also be used")
 	flag.StringVar(&options.CatalogPath, "catalogPath", "",
-		"The path to the catalog")
+		"The path to a YAML file overriding the services and plans generated from the charts")
 	flag.StringVar(&options.HelmRepoUrl, "helmUrl", "",
 		"The url to the helm repo")
+	flag.StringVar(&options.HelmRepos, "helmRepos", "",
+		"A comma separated list of name=url helm repos to use instead of '--helmUrl'. Charts found in several repos are qualified by the repo name, except in the first one")
+	flag.StringVar(&options.HelmReposFile, "helmReposFile", "",
+		"The path to a file listing the helm repos, in the format of the helm repositories.yaml file, with their secretDir and OCI charts. Takes precedence over '--helmRepos'")
+	flag.StringVar(&options.ChartCache.Dir, "chartCacheDir", "",
+		"The directory where downloaded charts and repository indexes are kept. Defaults to the helm home")
+	flag.BoolVar(&options.ChartCache.Offline, "offline", false,
+		"Serve charts and indexes only from the chart cache and from file:// repositories, without network access")
+	flag.DurationVar(&options.ChartCache.RefreshInterval, "repoRefreshInterval", 0,
+		"How often the repository indexes are checked for new charts. If 0, they are only downloaded at startup")
+	flag.StringVar(&options.ChartCache.Keyring, "keyring", "",
+		"The path of the public keyring verifying the provenance of the charts of the helm repos with a verify policy. Required when a repo has one")
+	flag.StringVar(&options.HelmBackend, "helmBackend", "tiller",
+		"How releases are installed: 'tiller', or 'secrets' to install them without Tiller and store their state in secrets")
+	flag.StringVar(&options.Tiller.Host, "tillerHost", "localhost:44134",
+		"The address of Tiller, as host:port")
+	flag.StringVar(&options.Tiller.TLSCert, "tillerTLSCert", "",
+		"The path of the client certificate presented to Tiller. Setting any of the Tiller TLS flags enables TLS")
+	flag.StringVar(&options.Tiller.TLSKey, "tillerTLSKey", "",
+		"The path of the private key matching '--tillerTLSCert'")
+	flag.StringVar(&options.Tiller.TLSCACert, "tillerTLSCACert", "",
+		"The path of the CA certificate used to verify Tiller. Required when TLS is enabled")
+	flag.DurationVar(&options.Tiller.ConnectTimeout, "tillerConnectTimeout", 5*time.Second,
+		"The timeout for connecting to Tiller")
+	flag.DurationVar(&options.Tiller.Timeout, "tillerTimeout", 5*time.Minute,
+		"The timeout for the operations Tiller runs, such as waiting for a release to be ready. Also bounds waiting for releases with '--helmBackend secrets'")
+	flag.StringVar(&options.Auth.CredentialsDir, "authCredentialsDir", "",
+		"The directory where a secret holding the username and password of the broker API is mounted. If not set, basic authentication is disabled")
+	flag.BoolVar(&options.Auth.TokenReview, "authTokenReview", false,
+		"Accept bearer tokens authenticated by the TokenReview API of the cluster")
+	flag.StringVar(&options.AuthTokenUsers, "authTokenUsers", "",
+		"A comma separated list of the only users bearer tokens are accepted from. If not set, any authenticated user is accepted")
 	flag.StringVar(&options.DefaultNamespace, "defaultNamespace", "",
 		"The default namespace for brokers when the request doesn't specify")
+	flag.BoolVar(&options.ForceNamespace, "forceNamespace", false,
+		"Provision every instance into '--defaultNamespace', whatever namespace the request asks for")
+	flag.StringVar(&options.CFNamespaceTemplate, "cfNamespaceTemplate", "",
+		"A Go template naming the namespace the instances of each Cloud Foundry space are provisioned into, e.g. 'cf-{{.SpaceGUID}}'. It is given the OrganizationGUID and SpaceGUID of the request context. If not set, they are provisioned into '--defaultNamespace'")
+	flag.StringVar(&options.AllowedNamespaces, "allowedNamespaces", "",
+		"A comma separated list of the namespaces instances may be provisioned into. If neither it nor '--allowedNamespacePattern' is set, all namespaces are allowed")
+	flag.StringVar(&options.Namespaces.AllowedPattern, "allowedNamespacePattern", "",
+		"A regular expression matching the whole names of other namespaces instances may be provisioned into")
+	flag.IntVar(&options.Namespaces.MaxInstances, "maxInstancesPerNamespace", 0,
+		"The maximum number of instances in each namespace, counting the ones whose provision failed until they are deprovisioned. If 0, it is unlimited")
+	flag.IntVar(&options.Namespaces.MaxServiceInstances, "maxServiceInstancesPerNamespace", 0,
+		"The maximum number of instances of each service in each namespace, counted the same way as '--maxInstancesPerNamespace'. If 0, it is unlimited")
 	flag.Parse()
 }
 
@@ -72,6 +121,17 @@ func runWithContext(ctx context.Context) error {
 
 	addr := ":" + strconv.Itoa(options.Port)
 
+	if options.AllowedNamespaces != "" {
+		options.Namespaces.Allowed = strings.Split(options.AllowedNamespaces, ",")
+	}
+	if options.AuthTokenUsers != "" {
+		options.Auth.TokenUsers = strings.Split(options.AuthTokenUsers, ",")
+	}
+	authenticate, err := broker.NewAuthMiddleware(options.Auth)
+	if err != nil {
+		return err
+	}
+
 	b, err := broker.NewBroker(options.Options)
 	if err != nil {
 		return err
@@ -80,7 +140,7 @@ func runWithContext(ctx context.Context) error {
 	// Prometheus metrics
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
-	reg.MustRegister(osbMetrics)
+	reg.MustRegister(osbMetrics, helm.LastRefreshTime)
 
 	api, err := rest.NewAPISurface(b, osbMetrics)
 	if err != nil {
@@ -88,6 +148,8 @@ func runWithContext(ctx context.Context) error {
 	}
 
 	s := server.New(api, reg)
+	s.Router = broker.NewRouter(b, osbMetrics, s.Router)
+	s.Router.Use(authenticate)
 
 	glog.Infof("Starting broker!")
 
@@ -100,7 +162,7 @@ func runWithContext(ctx context.Context) error {
 }
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	for {
@@ -0,0 +1,435 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/pmorie/osb-broker-lib/pkg/metrics"
+)
+
+// catalogService adds the fields osb.Service is missing for the OSB API
+// version the broker implements.
+type catalogService struct {
+	osb.Service
+	InstancesRetrievable bool          `json:"instances_retrievable,omitempty"`
+	Plans                []catalogPlan `json:"plans"`
+}
+
+// catalogPlan adds the fields osb.Plan is missing.
+type catalogPlan struct {
+	osb.Plan
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// MaintenanceInfo identifies the version of the chart a plan installs, so
+// that platforms can tell when instances are out of date.
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// maintenanceInfoConflictMessage is the error code of the requests whose
+// maintenance info differs from the one of their plan.
+const maintenanceInfoConflictMessage = "MaintenanceInfoConflict"
+
+type catalogResponse struct {
+	Services []catalogService `json:"services"`
+}
+
+// GetInstanceResponse is sent as the response to fetching a service instance.
+type GetInstanceResponse struct {
+	ServiceID       string                 `json:"service_id"`
+	PlanID          string                 `json:"plan_id"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+// bindingResponse is the body of bind and unbind responses. The osb types
+// name the operation operationKey and add an async field, neither of which
+// are part of the OSB API.
+type bindingResponse struct {
+	Credentials     map[string]interface{} `json:"credentials,omitempty"`
+	SyslogDrainURL  *string                `json:"syslog_drain_url,omitempty"`
+	RouteServiceURL *string                `json:"route_service_url,omitempty"`
+	VolumeMounts    []interface{}          `json:"volume_mounts,omitempty"`
+	Operation       *string                `json:"operation,omitempty"`
+}
+
+// api serves the OSB endpoints that osb-broker-lib does not dispatch to
+// broker.Interface.
+type api struct {
+	broker  *Broker
+	metrics *metrics.OSBMetricsCollector
+}
+
+// NewRouter returns a router serving the endpoints minibroker implements on
+// top of osb-broker-lib, handing every other request to fallback.
+func NewRouter(b *Broker, m *metrics.OSBMetricsCollector, fallback http.Handler) *mux.Router {
+	a := &api{broker: b, metrics: m}
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/catalog", a.getCatalogHandler).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", a.getInstanceHandler).Methods("GET")
+	router.Handle("/v2/service_instances/{instance_id}", a.checkMaintenanceInfo(fallback)).Methods("PUT", "PATCH")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", a.getBindingHandler).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", a.bindHandler).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", a.unbindHandler).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", a.bindingLastOperationHandler).Methods("GET")
+	router.PathPrefix("/").Handler(fallback)
+	return router
+}
+
+func (a *api) getCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	a.metrics.Actions.WithLabelValues("get_catalog").Inc()
+
+	if err := a.broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := a.broker.GetCatalog(c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	version := requestAPIVersion(r)
+	catalog := catalogResponse{
+		Services: make([]catalogService, 0, len(response.Services)),
+	}
+	for _, service := range response.Services {
+		// Platforms on older versions would not expect the fields
+		retrievable := version.atLeast(apiVersion2_14)
+		service.BindingsRetrievable = retrievable
+		entry := catalogService{
+			Service:              service,
+			InstancesRetrievable: retrievable,
+			Plans:                make([]catalogPlan, 0, len(service.Plans)),
+		}
+		for _, plan := range service.Plans {
+			planEntry := catalogPlan{Plan: plan}
+			if version.atLeast(apiVersion2_15) {
+				planEntry.MaintenanceInfo = a.broker.planMaintenanceInfo(service.ID, plan.ID)
+			}
+			entry.Plans = append(entry.Plans, planEntry)
+		}
+		catalog.Services = append(catalog.Services, entry)
+	}
+
+	writeResponse(w, http.StatusOK, catalog)
+}
+
+// checkMaintenanceInfo rejects the provisions and updates whose maintenance
+// info does not match their plan before handing them to next, as
+// osb-broker-lib does not parse it.
+func (a *api) checkMaintenanceInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requestAPIVersion(r).atLeast(apiVersion2_15) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var request struct {
+			ServiceID       string           `json:"service_id"`
+			PlanID          string           `json:"plan_id"`
+			MaintenanceInfo *MaintenanceInfo `json:"maintenance_info"`
+		}
+		// Malformed requests are rejected by next
+		if err := json.Unmarshal(body, &request); err != nil || request.MaintenanceInfo == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		instanceID := mux.Vars(r)[osb.VarKeyInstanceID]
+		if err := a.broker.checkMaintenanceInfo(instanceID, request.ServiceID, request.PlanID, request.MaintenanceInfo); err != nil {
+			glog.Errorln(err)
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *api) getInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	a.metrics.Actions.WithLabelValues("get_instance").Inc()
+
+	if err := a.broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	if err := requireAPIVersion(r, apiVersion2_14, "fetching instances"); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	instanceID := mux.Vars(r)[osb.VarKeyInstanceID]
+
+	glog.V(4).Infof("Received GetInstanceRequest for instanceID %q", instanceID)
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := a.broker.GetInstance(instanceID, c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+func (a *api) getBindingHandler(w http.ResponseWriter, r *http.Request) {
+	a.metrics.Actions.WithLabelValues("get_binding").Inc()
+
+	if err := a.broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	if err := requireAPIVersion(r, apiVersion2_14, "fetching bindings"); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.GetBindingRequest{
+		InstanceID: vars[osb.VarKeyInstanceID],
+		BindingID:  vars[osb.VarKeyBindingID],
+	}
+
+	glog.V(4).Infof("Received GetBindingRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := a.broker.GetBinding(request, c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+// bindHandler replaces the osb-broker-lib handler, which neither reads
+// accepts_incomplete from the query string nor answers 202 to asynchronous
+// binds.
+func (a *api) bindHandler(w http.ResponseWriter, r *http.Request) {
+	a.metrics.Actions.WithLabelValues("bind").Inc()
+
+	if err := a.broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	request := &osb.BindRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	request.InstanceID = vars[osb.VarKeyInstanceID]
+	request.BindingID = vars[osb.VarKeyBindingID]
+	request.AcceptsIncomplete = acceptsIncomplete(r) && requestAPIVersion(r).atLeast(apiVersion2_14)
+	request.OriginatingIdentity = originatingIdentity(r)
+
+	glog.V(4).Infof("Received BindRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := a.broker.Bind(request, c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeBindResponse(w, response)
+}
+
+// unbindHandler replaces the osb-broker-lib handler for the same reasons as
+// bindHandler.
+func (a *api) unbindHandler(w http.ResponseWriter, r *http.Request) {
+	a.metrics.Actions.WithLabelValues("unbind").Inc()
+
+	if err := a.broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.UnbindRequest{
+		InstanceID:          vars[osb.VarKeyInstanceID],
+		BindingID:           vars[osb.VarKeyBindingID],
+		ServiceID:           r.FormValue(osb.VarKeyServiceID),
+		PlanID:              r.FormValue(osb.VarKeyPlanID),
+		AcceptsIncomplete:   acceptsIncomplete(r) && requestAPIVersion(r).atLeast(apiVersion2_14),
+		OriginatingIdentity: originatingIdentity(r),
+	}
+
+	glog.V(4).Infof("Received UnbindRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := a.broker.Unbind(request, c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeUnbindResponse(w, response)
+}
+
+func (a *api) bindingLastOperationHandler(w http.ResponseWriter, r *http.Request) {
+	a.metrics.Actions.WithLabelValues("binding_last_operation").Inc()
+
+	if err := a.broker.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	if err := requireAPIVersion(r, apiVersion2_14, "asynchronous bindings"); err != nil {
+		writeError(w, err, http.StatusPreconditionFailed)
+		return
+	}
+
+	vars := mux.Vars(r)
+	request := &osb.BindingLastOperationRequest{
+		InstanceID: vars[osb.VarKeyInstanceID],
+		BindingID:  vars[osb.VarKeyBindingID],
+	}
+	if serviceID := r.FormValue(osb.VarKeyServiceID); serviceID != "" {
+		request.ServiceID = &serviceID
+	}
+	if planID := r.FormValue(osb.VarKeyPlanID); planID != "" {
+		request.PlanID = &planID
+	}
+	if operation := r.FormValue(osb.VarKeyOperation); operation != "" {
+		operationKey := osb.OperationKey(operation)
+		request.OperationKey = &operationKey
+	}
+
+	glog.V(4).Infof("Received BindingLastOperationRequest for instanceID %q, bindingID %q", request.InstanceID, request.BindingID)
+
+	c := &broker.RequestContext{
+		Writer:  w,
+		Request: r,
+	}
+
+	response, err := a.broker.BindingLastOperation(request, c)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+func acceptsIncomplete(r *http.Request) bool {
+	return strings.ToLower(r.FormValue(osb.AcceptsIncomplete)) == "true"
+}
+
+// originatingIdentity decodes the originating identity header the same way
+// osb-broker-lib does, returning nil when it is missing or malformed.
+func originatingIdentity(r *http.Request) *osb.OriginatingIdentity {
+	header := r.Header.Get(osb.OriginatingIdentityHeader)
+	parts := strings.Split(header, " ")
+	if len(parts) != 2 {
+		return nil
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		glog.Infof("invalid header for originating origin - %v", header)
+		return nil
+	}
+	return &osb.OriginatingIdentity{
+		Platform: parts[0],
+		Value:    string(value),
+	}
+}
+
+func writeBindResponse(w http.ResponseWriter, response *broker.BindResponse) {
+	status := http.StatusCreated
+	if response.Async {
+		status = http.StatusAccepted
+	} else if response.Exists {
+		status = http.StatusOK
+	}
+	writeResponse(w, status, bindingResponse{
+		Credentials:     response.Credentials,
+		SyslogDrainURL:  response.SyslogDrainURL,
+		RouteServiceURL: response.RouteServiceURL,
+		VolumeMounts:    response.VolumeMounts,
+		Operation:       (*string)(response.OperationKey),
+	})
+}
+
+func writeUnbindResponse(w http.ResponseWriter, response *broker.UnbindResponse) {
+	status := http.StatusOK
+	if response.Async {
+		status = http.StatusAccepted
+	}
+	writeResponse(w, status, bindingResponse{
+		Operation: (*string)(response.OperationKey),
+	})
+}
+
+// writeResponse serializes object as the JSON body of the response.
+func writeResponse(w http.ResponseWriter, code int, object interface{}) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// writeError writes err the same way osb-broker-lib does: OSB errors keep
+// their status code, anything else is reported with defaultStatusCode.
+func writeError(w http.ResponseWriter, err error, defaultStatusCode int) {
+	type e struct {
+		ErrorMessage *string `json:"error,omitempty"`
+		Description  *string `json:"description,omitempty"`
+	}
+
+	if httpErr, ok := osb.IsHTTPError(err); ok {
+		writeResponse(w, httpErr.StatusCode, &e{
+			ErrorMessage: httpErr.ErrorMessage,
+			Description:  httpErr.Description,
+		})
+		return
+	}
+
+	description := err.Error()
+	writeResponse(w, defaultStatusCode, &e{Description: &description})
+}
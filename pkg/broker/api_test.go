@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+func TestBindingResponses(t *testing.T) {
+	bindKey := osb.OperationKey("bind-1")
+	unbindKey := osb.OperationKey("unbind-1")
+	tests := []struct {
+		name   string
+		write  func(w http.ResponseWriter)
+		status int
+		body   string
+	}{
+		{
+			"bind",
+			func(w http.ResponseWriter) {
+				writeBindResponse(w, &broker.BindResponse{BindResponse: osb.BindResponse{
+					Credentials: map[string]interface{}{"password": "secret"},
+				}})
+			},
+			http.StatusCreated,
+			`{"credentials":{"password":"secret"}}`,
+		},
+		{
+			"existing bind",
+			func(w http.ResponseWriter) {
+				writeBindResponse(w, &broker.BindResponse{
+					BindResponse: osb.BindResponse{Credentials: map[string]interface{}{"password": "secret"}},
+					Exists:       true,
+				})
+			},
+			http.StatusOK,
+			`{"credentials":{"password":"secret"}}`,
+		},
+		{
+			"asynchronous bind",
+			func(w http.ResponseWriter) {
+				writeBindResponse(w, &broker.BindResponse{BindResponse: osb.BindResponse{
+					Async:        true,
+					OperationKey: &bindKey,
+				}})
+			},
+			http.StatusAccepted,
+			`{"operation":"bind-1"}`,
+		},
+		{
+			"unbind",
+			func(w http.ResponseWriter) {
+				writeUnbindResponse(w, &broker.UnbindResponse{})
+			},
+			http.StatusOK,
+			`{}`,
+		},
+		{
+			"asynchronous unbind",
+			func(w http.ResponseWriter) {
+				writeUnbindResponse(w, &broker.UnbindResponse{UnbindResponse: osb.UnbindResponse{
+					Async:        true,
+					OperationKey: &unbindKey,
+				}})
+			},
+			http.StatusAccepted,
+			`{"operation":"unbind-1"}`,
+		},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.write(rec)
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d, actual %d", tt.name, tt.status, rec.Code)
+		}
+		if body := rec.Body.String(); body != tt.body {
+			t.Errorf("%s: expected body %s, actual %s", tt.name, tt.body, body)
+		}
+	}
+}
+
+func TestMaintenanceInfo(t *testing.T) {
+	if err := maintenanceInfoConflict(&MaintenanceInfo{Version: "1.2.0"}, "1.2.0"); err != nil {
+		t.Errorf("expected a matching version to be accepted, got %v", err)
+	}
+	err := maintenanceInfoConflict(&MaintenanceInfo{Version: "1.1.0"}, "1.2.0")
+	if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusUnprocessableEntity || *httpErr.ErrorMessage != maintenanceInfoConflictMessage {
+		t.Errorf("expected a MaintenanceInfoConflict error, got %v", err)
+	}
+
+	// Requests without maintenance info reach the provision and update
+	// handlers untouched
+	a := &api{}
+	for _, version := range []string{"2.14", "2.15"} {
+		body := `{"service_id":"mysql","plan_id":"mysql-5-7-14"}`
+		var received string
+		handler := a.checkMaintenanceInfo(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			received = string(data)
+		}))
+		r := httptest.NewRequest("PUT", "/v2/service_instances/1", strings.NewReader(body))
+		r.Header.Set(osb.APIVersionHeader, version)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if received != body {
+			t.Errorf("%s: expected the request body %s, actual %s", version, body, received)
+		}
+	}
+}
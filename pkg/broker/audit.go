@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/minibroker/pkg/minibroker"
+)
+
+// auditRecord is logged for every request changing an instance or a binding,
+// on a single line starting with "AUDIT" so that it can be told apart from
+// the other logs.
+type auditRecord struct {
+	Time       time.Time                       `json:"time"`
+	Action     string                          `json:"action"`
+	InstanceID string                          `json:"instance_id"`
+	BindingID  string                          `json:"binding_id,omitempty"`
+	ServiceID  string                          `json:"service_id,omitempty"`
+	PlanID     string                          `json:"plan_id,omitempty"`
+	Identity   *minibroker.OriginatingIdentity `json:"identity,omitempty"`
+	// Outcome is "accepted" when the request succeeded or was started, and
+	// "rejected" otherwise
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// audit logs the record of a request, which failed with err if not nil.
+func audit(record auditRecord, err error) {
+	record.Time = time.Now().UTC()
+	record.Outcome = "accepted"
+	if err != nil {
+		record.Outcome = "rejected"
+		record.Error = err.Error()
+	}
+
+	data, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		glog.Errorf("Could not marshall the audit record of %s %s: %s", record.Action, record.InstanceID, marshalErr)
+		return
+	}
+	glog.Infof("AUDIT %s", data)
+}
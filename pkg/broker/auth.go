@@ -0,0 +1,229 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Keys of the secret mounted at the CredentialsDir.
+const (
+	credentialsUsernameKey = "username"
+	credentialsPasswordKey = "password"
+)
+
+// tokenCacheTTL is how long a reviewed bearer token is trusted without
+// reviewing it again.
+const tokenCacheTTL = time.Minute
+
+// AuthOptions configures how the requests to the broker API are
+// authenticated. They are not authenticated when neither basic
+// authentication nor bearer tokens are enabled.
+type AuthOptions struct {
+	// CredentialsDir is where a secret holding the username and password of
+	// the basic authentication is mounted. They are read on every request so
+	// that rotated secrets are picked up.
+	CredentialsDir string
+	// TokenReview accepts bearer tokens authenticated by the TokenReview API
+	// of the cluster, e.g. service account tokens
+	TokenReview bool
+	// TokenUsers are the only users bearer tokens are accepted from, e.g.
+	// system:serviceaccount:catalog:service-catalog-controller-manager. Any
+	// authenticated user is accepted when empty.
+	TokenUsers []string
+}
+
+// tokenReviewer is the part of the TokenReview client the broker uses.
+type tokenReviewer interface {
+	Create(*authv1.TokenReview) (*authv1.TokenReview, error)
+}
+
+type authenticator struct {
+	AuthOptions
+	tokenReviews tokenReviewer
+
+	mu sync.Mutex
+	// tokens are the recently accepted tokens, by digest
+	tokens map[[sha256.Size]byte]reviewedToken
+}
+
+type reviewedToken struct {
+	user   string
+	expiry time.Time
+}
+
+// NewAuthMiddleware returns the middleware authenticating the requests to the
+// OSB API, which is every request under /v2/. Other endpoints, such as
+// /healthz and /metrics, are left open.
+func NewAuthMiddleware(o AuthOptions) (mux.MiddlewareFunc, error) {
+	if o.CredentialsDir == "" && !o.TokenReview {
+		glog.Warningf("Neither basic authentication nor bearer tokens are enabled, the broker API is not authenticated")
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+
+	a := &authenticator{
+		AuthOptions: o,
+		tokens:      map[[sha256.Size]byte]reviewedToken{},
+	}
+	if o.CredentialsDir != "" {
+		if _, _, err := a.credentials(); err != nil {
+			return nil, err
+		}
+	}
+	if o.TokenReview {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load the cluster config to review tokens")
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create the client to review tokens")
+		}
+		a.tokenReviews = clientset.AuthenticationV1().TokenReviews()
+	}
+	return a.middleware, nil
+}
+
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := a.authenticate(r)
+		if err != nil {
+			glog.Warningf("Rejecting %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+			if a.CredentialsDir != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="minibroker"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="minibroker"`)
+			}
+			msg := "the request could not be authenticated"
+			writeError(w, osb.HTTPStatusCodeError{
+				StatusCode:  http.StatusUnauthorized,
+				Description: &msg,
+			}, http.StatusUnauthorized)
+			return
+		}
+
+		glog.V(4).Infof("%s %s authenticated as %s", r.Method, r.URL.Path, user)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the user a request is authenticated as.
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+	if username, password, ok := r.BasicAuth(); ok {
+		if a.CredentialsDir == "" {
+			return "", errors.New("basic authentication is not enabled")
+		}
+		return username, a.checkPassword(username, password)
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		if !a.TokenReview {
+			return "", errors.New("bearer tokens are not enabled")
+		}
+		return a.reviewToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	}
+	return "", errors.New("no credentials")
+}
+
+// credentials reads the username and password of the basic authentication.
+func (a *authenticator) credentials() (string, string, error) {
+	username, err := ioutil.ReadFile(filepath.Join(a.CredentialsDir, credentialsUsernameKey))
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not read the broker username")
+	}
+	password, err := ioutil.ReadFile(filepath.Join(a.CredentialsDir, credentialsPasswordKey))
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not read the broker password")
+	}
+	return strings.TrimSpace(string(username)), strings.TrimSpace(string(password)), nil
+}
+
+func (a *authenticator) checkPassword(username, password string) error {
+	expectedUsername, expectedPassword, err := a.credentials()
+	if err != nil {
+		return err
+	}
+	if expectedUsername == "" {
+		return errors.New("the broker username is empty")
+	}
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername))
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword))
+	if usernameMatch&passwordMatch != 1 {
+		return errors.New("invalid username or password")
+	}
+	return nil
+}
+
+// reviewToken authenticates a bearer token with the TokenReview API, and
+// returns the user it belongs to. Accepted tokens are cached for a short
+// while so that every request does not cost a review.
+func (a *authenticator) reviewToken(token string) (string, error) {
+	if token == "" {
+		return "", errors.New("empty bearer token")
+	}
+	key := sha256.Sum256([]byte(token))
+
+	a.mu.Lock()
+	reviewed, cached := a.tokens[key]
+	a.mu.Unlock()
+	if cached && time.Now().Before(reviewed.expiry) {
+		return reviewed.user, nil
+	}
+
+	review, err := a.tokenReviews.Create(&authv1.TokenReview{
+		Spec: authv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "could not review the bearer token")
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return "", errors.Errorf("invalid bearer token: %s", review.Status.Error)
+		}
+		return "", errors.New("invalid bearer token")
+	}
+
+	user := review.Status.User.Username
+	if len(a.TokenUsers) > 0 && !containsString(a.TokenUsers, user) {
+		return "", errors.Errorf("user %s is not allowed", user)
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	for k, reviewed := range a.tokens {
+		if now.After(reviewed.expiry) {
+			delete(a.tokens, k)
+		}
+	}
+	a.tokens[key] = reviewedToken{user: user, expiry: now.Add(tokenCacheTTL)}
+	a.mu.Unlock()
+	return user, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
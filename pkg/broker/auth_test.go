@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+type fakeTokenReviewer struct {
+	users   map[string]string
+	reviews int
+}
+
+func (f *fakeTokenReviewer) Create(review *authv1.TokenReview) (*authv1.TokenReview, error) {
+	f.reviews++
+	user, ok := f.users[review.Spec.Token]
+	review.Status = authv1.TokenReviewStatus{
+		Authenticated: ok,
+		User:          authv1.UserInfo{Username: user},
+	}
+	return review, nil
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minibroker-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for key, value := range map[string]string{"username": "user", "password": "pass\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, key), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reviewer := &fakeTokenReviewer{users: map[string]string{
+		"catalog-token": "system:serviceaccount:catalog:controller",
+		"other-token":   "system:serviceaccount:default:default",
+	}}
+	a := &authenticator{
+		AuthOptions: AuthOptions{
+			CredentialsDir: dir,
+			TokenReview:    true,
+			TokenUsers:     []string{"system:serviceaccount:catalog:controller"},
+		},
+		tokenReviews: reviewer,
+		tokens:       map[[sha256.Size]byte]reviewedToken{},
+	}
+	handler := a.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		path       string
+		authorize  func(*http.Request)
+		wantStatus int
+	}{
+		{"no credentials", "/v2/catalog", func(*http.Request) {}, http.StatusUnauthorized},
+		{"basic", "/v2/catalog", func(r *http.Request) { r.SetBasicAuth("user", "pass") }, http.StatusOK},
+		{"wrong password", "/v2/catalog", func(r *http.Request) { r.SetBasicAuth("user", "wrong") }, http.StatusUnauthorized},
+		{"wrong username", "/v2/catalog", func(r *http.Request) { r.SetBasicAuth("admin", "pass") }, http.StatusUnauthorized},
+		{"token", "/v2/catalog", func(r *http.Request) { r.Header.Set("Authorization", "Bearer catalog-token") }, http.StatusOK},
+		{"token of another user", "/v2/catalog", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other-token") }, http.StatusUnauthorized},
+		{"invalid token", "/v2/catalog", func(r *http.Request) { r.Header.Set("Authorization", "Bearer invalid") }, http.StatusUnauthorized},
+		{"healthz", "/healthz", func(*http.Request) {}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			tt.authorize(req)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, expected %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected a WWW-Authenticate challenge")
+			}
+		})
+	}
+
+	reviews := reviewer.reviews
+	req := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	req.Header.Set("Authorization", "Bearer catalog-token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if reviewer.reviews != reviews {
+		t.Errorf("expected the accepted token to be cached, got %d more reviews", reviewer.reviews-reviews)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	req.SetBasicAuth("user", "rotated")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the rotated password to be accepted, got status %d", rec.Code)
+	}
+}
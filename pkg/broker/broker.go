@@ -2,7 +2,9 @@ package broker
 
 import (
 	"errors"
-	"sync"
+	"fmt"
+	"net/http"
+	"text/template"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-sigs/minibroker/pkg/minibroker"
@@ -14,8 +16,25 @@ import (
 // with. NewBroker is the place where you will initialize your
 // Broker the parameters passed in.
 func NewBroker(o Options) (*Broker, error) {
-	mb := minibroker.NewClient(o.HelmRepoUrl, o.ServiceCatalogEnabledOnly)
-	err := mb.Init()
+	repos, err := o.repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	if o.ForceNamespace && o.DefaultNamespace == "" {
+		return nil, errors.New("a default namespace is required to force instances into it")
+	}
+
+	cfNamespaceTemplate, err := parseCFNamespaceTemplate(o.CFNamespaceTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	mb, err := minibroker.NewClient(repos, o.ChartCache, o.HelmBackend, o.Tiller, o.CatalogPath, o.ServiceCatalogEnabledOnly, o.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	err = mb.Init()
 	if err != nil {
 		return nil, err
 	}
@@ -23,11 +42,21 @@ func NewBroker(o Options) (*Broker, error) {
 	// For example, if your Broker requires a parameter from the command
 	// line, you would unpack it from the Options and set it on the
 	// Broker here.
-	return &Broker{
-		Client:           mb,
-		async:            true,
-		defaultNamespace: o.DefaultNamespace,
-	}, nil
+	b := &Broker{
+		Client:              mb,
+		async:               true,
+		locks:               newOperationLocks(),
+		defaultNamespace:    o.DefaultNamespace,
+		forceNamespace:      o.ForceNamespace,
+		cfNamespaceTemplate: cfNamespaceTemplate,
+	}
+
+	err = mb.RecoverOperations(b.locks)
+	if err != nil {
+		glog.Errorf("Could not recover operations in progress: %s", err)
+	}
+
+	return b, nil
 }
 
 // Broker provides an implementation of broker.Interface
@@ -36,10 +65,14 @@ type Broker struct {
 
 	// Indiciates if the broker should handle the requests asynchronously.
 	async bool
-	// Synchronize go routines.
-	sync.RWMutex
+	// Synchronize go routines operating on the same instance or binding.
+	locks *operationLocks
 	// Default namespace to run brokers if not specified during request
 	defaultNamespace string
+	// Run every broker in the default namespace, whatever the request says
+	forceNamespace bool
+	// Names the namespace of the brokers of each Cloud Foundry space
+	cfNamespaceTemplate *template.Template
 }
 
 var _ broker.Interface = &Broker{}
@@ -59,13 +92,40 @@ func (b *Broker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse,
 	return response, nil
 }
 
+// Provision installs an instance on behalf of the originating identity of the
+// request. Like the other requests changing instances and bindings, it is
+// audited along with its outcome.
 func (b *Broker) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
-	b.Lock()
-	defer b.Unlock()
+	var response *broker.ProvisionResponse
+	identity, err := minibroker.ParseOriginatingIdentity(request.OriginatingIdentity)
+	if err == nil {
+		response, err = b.provision(request, identity)
+	}
+	audit(auditRecord{
+		Action:     "provision",
+		InstanceID: request.InstanceID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+		Identity:   identity,
+	}, err)
+	return response, err
+}
+
+func (b *Broker) provision(request *osb.ProvisionRequest, identity *minibroker.OriginatingIdentity) (*broker.ProvisionResponse, error) {
+	unlock, ok := b.locks.LockInstance(request.InstanceID)
+	if !ok {
+		return nil, concurrencyError()
+	}
+	defer unlock()
 
-	namespace := b.defaultNamespace
-	if request.Context["namespace"] != nil {
-		namespace = request.Context["namespace"].(string)
+	ctx, err := parseContext(request.Context)
+	if err != nil {
+		return nil, err
+	}
+	namespace, createNamespace, err := b.resolveNamespace(ctx)
+	if err != nil {
+		glog.Errorln(err)
+		return nil, err
 	}
 
 	if namespace == "" {
@@ -74,9 +134,9 @@ func (b *Broker) Provision(request *osb.ProvisionRequest, c *broker.RequestConte
 		return nil, err
 	}
 
-	glog.V(5).Infof("Provisioning %s (%s/%s) in %s", request.InstanceID, request.ServiceID, request.PlanID, namespace)
+	glog.V(5).Infof("Provisioning %s (%s/%s) in %s for %s", request.InstanceID, request.ServiceID, request.PlanID, namespace, identity)
 
-	operationName, err := b.Client.Provision(request.InstanceID, request.ServiceID, request.PlanID, namespace, request.AcceptsIncomplete, request.Parameters)
+	operationName, err := b.Client.Provision(request.InstanceID, request.ServiceID, request.PlanID, namespace, createNamespace, request.AcceptsIncomplete, request.Parameters, identity)
 	if err != nil {
 		glog.Errorln(err)
 		return nil, err
@@ -94,9 +154,28 @@ func (b *Broker) Provision(request *osb.ProvisionRequest, c *broker.RequestConte
 }
 
 func (b *Broker) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
+	var response *broker.DeprovisionResponse
+	identity, err := minibroker.ParseOriginatingIdentity(request.OriginatingIdentity)
+	if err == nil {
+		response, err = b.deprovision(request)
+	}
+	audit(auditRecord{
+		Action:     "deprovision",
+		InstanceID: request.InstanceID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+		Identity:   identity,
+	}, err)
+	return response, err
+}
+
+func (b *Broker) deprovision(request *osb.DeprovisionRequest) (*broker.DeprovisionResponse, error) {
 	glog.V(5).Infof("Deprovisioning %s (%s/%s)", request.InstanceID, request.ServiceID, request.PlanID)
-	b.Lock()
-	defer b.Unlock()
+	unlock, ok := b.locks.LockInstance(request.InstanceID)
+	if !ok {
+		return nil, concurrencyError()
+	}
+	defer unlock()
 
 	operationName, err := b.Client.Deprovision(request.InstanceID, request.AcceptsIncomplete)
 	if err != nil {
@@ -118,8 +197,6 @@ func (b *Broker) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestC
 // LastOperation provides information on the state of the last asynchronous operation
 func (b *Broker) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
 	glog.V(5).Infof("Getting last operation of %s (%v/%v)", request.InstanceID, request.ServiceID, request.PlanID)
-	b.Lock()
-	defer b.Unlock()
 
 	response, err := b.Client.LastOperationState(request.InstanceID, request.OperationKey)
 	if err != nil {
@@ -134,23 +211,39 @@ func (b *Broker) LastOperation(request *osb.LastOperationRequest, c *broker.Requ
 }
 
 func (b *Broker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
+	var response *broker.BindResponse
+	identity, err := minibroker.ParseOriginatingIdentity(request.OriginatingIdentity)
+	if err == nil {
+		response, err = b.bind(request)
+	}
+	audit(auditRecord{
+		Action:     "bind",
+		InstanceID: request.InstanceID,
+		BindingID:  request.BindingID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+		Identity:   identity,
+	}, err)
+	return response, err
+}
+
+func (b *Broker) bind(request *osb.BindRequest) (*broker.BindResponse, error) {
 	glog.V(5).Infof("Binding %s (%s)", request.InstanceID, request.ServiceID)
-	b.Lock()
-	defer b.Unlock()
+	unlock, ok := b.locks.LockBinding(request.InstanceID, request.BindingID)
+	if !ok {
+		return nil, concurrencyError()
+	}
+	defer unlock()
 
-	creds, err := b.Client.Bind(request.InstanceID, request.ServiceID, request.Parameters)
+	bindResponse, exists, err := b.Client.Bind(request.InstanceID, request.ServiceID, request.PlanID, request.BindingID, request.AcceptsIncomplete && b.async, request.Parameters)
 	if err != nil {
 		glog.Errorln(err)
 		return nil, err
 	}
 
 	response := broker.BindResponse{
-		BindResponse: osb.BindResponse{
-			Credentials: creds,
-		},
-	}
-	if request.AcceptsIncomplete {
-		response.Async = false // We do not currently accept asynchronous operations on bind
+		BindResponse: *bindResponse,
+		Exists:       exists,
 	}
 
 	glog.V(5).Infof("Successfully binding %s (%s)", request.InstanceID, request.ServiceID)
@@ -159,29 +252,186 @@ func (b *Broker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*brok
 }
 
 func (b *Broker) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
+	var response *broker.UnbindResponse
+	identity, err := minibroker.ParseOriginatingIdentity(request.OriginatingIdentity)
+	if err == nil {
+		response, err = b.unbind(request)
+	}
+	audit(auditRecord{
+		Action:     "unbind",
+		InstanceID: request.InstanceID,
+		BindingID:  request.BindingID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+		Identity:   identity,
+	}, err)
+	return response, err
+}
+
+func (b *Broker) unbind(request *osb.UnbindRequest) (*broker.UnbindResponse, error) {
 	glog.V(5).Infof("Unbinding %s (%s)", request.InstanceID, request.ServiceID)
-	// nothing to do
+	unlock, ok := b.locks.LockBinding(request.InstanceID, request.BindingID)
+	if !ok {
+		return nil, concurrencyError()
+	}
+	defer unlock()
+
+	operationName, err := b.Client.Unbind(request.InstanceID, request.ServiceID, request.BindingID, request.AcceptsIncomplete && b.async)
+	if err != nil {
+		glog.Errorln(err)
+		return nil, err
+	}
 
 	response := broker.UnbindResponse{}
-	if request.AcceptsIncomplete {
-		response.Async = false // We do not currently accept asynchronous operations on unbind
+	if request.AcceptsIncomplete && b.async {
+		response.Async = true
+		operationKey := osb.OperationKey(operationName)
+		response.OperationKey = &operationKey
 	}
 
 	glog.V(5).Infof("Successfully unbinding %s (%s)", request.InstanceID, request.ServiceID)
 	return &response, nil
 }
 
+// BindingLastOperation provides information on the state of the last
+// asynchronous operation on a binding
+func (b *Broker) BindingLastOperation(request *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	glog.V(5).Infof("Getting last operation of binding %s of %s", request.BindingID, request.InstanceID)
+
+	response, err := b.Client.BindingLastOperationState(request.InstanceID, request.BindingID, request.OperationKey)
+	if err != nil {
+		glog.Errorln(err)
+		return nil, err
+	}
+
+	wrappedResponse := broker.LastOperationResponse{LastOperationResponse: *response}
+
+	glog.V(5).Infof("Successfully got last operation of binding %s of %s: %+v", request.BindingID, request.InstanceID, response)
+	return &wrappedResponse, nil
+}
+
+// GetInstance returns the service, plan and parameters of an instance
+func (b *Broker) GetInstance(instanceID string, c *broker.RequestContext) (*GetInstanceResponse, error) {
+	glog.V(5).Infof("Getting instance %s", instanceID)
+	instance, err := b.Client.GetInstance(instanceID)
+	if err != nil {
+		glog.Errorln(err)
+		return nil, err
+	}
+
+	response := &GetInstanceResponse{
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		Parameters: instance.Parameters,
+	}
+	if requestAPIVersion(c.Request).atLeast(apiVersion2_15) && instance.ChartVersion != "" {
+		response.MaintenanceInfo = &MaintenanceInfo{Version: instance.ChartVersion}
+	}
+
+	glog.V(5).Infof("Successfully got instance %s", instanceID)
+	return response, nil
+}
+
+// planMaintenanceInfo returns the maintenance info of a plan, which is the
+// version of the chart it installs.
+func (b *Broker) planMaintenanceInfo(serviceID, planID string) *MaintenanceInfo {
+	chartVersion, err := b.Client.PlanChartVersion(serviceID, planID)
+	if err != nil {
+		glog.Errorf("Could not find the chart version of plan %s of %s: %s", planID, serviceID, err)
+		return nil
+	}
+	return &MaintenanceInfo{
+		Version:     chartVersion,
+		Description: fmt.Sprintf("Chart version %s", chartVersion),
+	}
+}
+
+// checkMaintenanceInfo rejects the maintenance info of a provision or update
+// that differs from the one of the plan it installs, e.g. when the platform
+// has an outdated catalog. Updates that do not change the plan are checked
+// against the plan of the instance.
+func (b *Broker) checkMaintenanceInfo(instanceID, serviceID, planID string, info *MaintenanceInfo) error {
+	if planID == "" {
+		instance, err := b.Client.GetInstance(instanceID)
+		if err != nil {
+			// Reported by the update itself
+			return nil
+		}
+		serviceID, planID = instance.ServiceID, instance.PlanID
+	}
+	chartVersion, err := b.Client.PlanChartVersion(serviceID, planID)
+	if err != nil {
+		// Plans that are not offered are reported by the request itself
+		return nil
+	}
+	return maintenanceInfoConflict(info, chartVersion)
+}
+
+func maintenanceInfoConflict(info *MaintenanceInfo, chartVersion string) error {
+	if info.Version == chartVersion {
+		return nil
+	}
+	msg := fmt.Sprintf("maintenance info version %s does not match the version %s of the plan", info.Version, chartVersion)
+	return osb.HTTPStatusCodeError{
+		StatusCode:   http.StatusUnprocessableEntity,
+		ErrorMessage: &[]string{maintenanceInfoConflictMessage}[0],
+		Description:  &msg,
+	}
+}
+
+// GetBinding returns a previously created binding
+func (b *Broker) GetBinding(request *osb.GetBindingRequest, c *broker.RequestContext) (*osb.GetBindingResponse, error) {
+	glog.V(5).Infof("Getting binding %s of %s", request.BindingID, request.InstanceID)
+	response, err := b.Client.GetBinding(request.InstanceID, request.BindingID)
+	if err != nil {
+		glog.Errorln(err)
+		return nil, err
+	}
+
+	glog.V(5).Infof("Successfully got binding %s of %s", request.BindingID, request.InstanceID)
+	return response, nil
+}
+
 func (b *Broker) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
-	// Not supported, do nothing
+	var response *broker.UpdateInstanceResponse
+	identity, err := minibroker.ParseOriginatingIdentity(request.OriginatingIdentity)
+	if err == nil {
+		response, err = b.update(request)
+	}
+	record := auditRecord{
+		Action:     "update",
+		InstanceID: request.InstanceID,
+		ServiceID:  request.ServiceID,
+		Identity:   identity,
+	}
+	if request.PlanID != nil {
+		record.PlanID = *request.PlanID
+	}
+	audit(record, err)
+	return response, err
+}
+
+func (b *Broker) update(request *osb.UpdateInstanceRequest) (*broker.UpdateInstanceResponse, error) {
+	glog.V(5).Infof("Updating %s (%s)", request.InstanceID, request.ServiceID)
+	unlock, ok := b.locks.LockInstance(request.InstanceID)
+	if !ok {
+		return nil, concurrencyError()
+	}
+	defer unlock()
+
+	operationName, err := b.Client.Update(request.InstanceID, request.ServiceID, request.PlanID, request.AcceptsIncomplete, request.Parameters)
+	if err != nil {
+		glog.Errorln(err)
+		return nil, err
+	}
 
 	response := broker.UpdateInstanceResponse{}
 	if request.AcceptsIncomplete {
-		response.Async = false // We do not currently accept asynchronous operations on update
+		response.Async = b.async
+		operationKey := osb.OperationKey(operationName)
+		response.OperationKey = &operationKey
 	}
 
+	glog.V(5).Infof("Successfully initiated updating %s (%s)", request.InstanceID, request.ServiceID)
 	return &response, nil
 }
-
-func (b *Broker) ValidateBrokerAPIVersion(version string) error {
-	return nil
-}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/kubernetes-sigs/minibroker/pkg/minibroker"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// requestContext is the context a platform provisions an instance in, as sent
+// in the context field of the request.
+type requestContext struct {
+	Platform string
+	// Namespace is sent by Kubernetes platforms
+	Namespace string
+	// OrganizationGUID and SpaceGUID are sent by Cloud Foundry
+	OrganizationGUID string
+	SpaceGUID        string
+}
+
+// parseContext reads the fields of a request context minibroker uses,
+// rejecting the ones that are not strings.
+func parseContext(context map[string]interface{}) (requestContext, error) {
+	var c requestContext
+	fields := map[string]*string{
+		"platform":          &c.Platform,
+		"namespace":         &c.Namespace,
+		"organization_guid": &c.OrganizationGUID,
+		"space_guid":        &c.SpaceGUID,
+	}
+	for key, field := range fields {
+		value, ok := context[key]
+		if !ok || value == nil {
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			return requestContext{}, invalidContext(fmt.Sprintf("%s must be a string", key))
+		}
+		*field = s
+	}
+	return c, nil
+}
+
+// cfNamespace is the data of the template naming the namespace of the
+// instances of a Cloud Foundry space.
+type cfNamespace struct {
+	OrganizationGUID string
+	SpaceGUID        string
+}
+
+// parseCFNamespaceTemplate parses the template naming the namespaces of Cloud
+// Foundry spaces, e.g. cf-{{.SpaceGUID}}, and checks it names valid
+// namespaces.
+func parseCFNamespaceTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("namespace").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Cloud Foundry namespace template")
+	}
+	example := cfNamespace{
+		OrganizationGUID: "5a2e3b1c-0d4f-4e6a-8b7c-9d0e1f2a3b4c",
+		SpaceGUID:        "6b3f4c2d-1e5a-4f7b-9c8d-0e1f2a3b4c5d",
+	}
+	if _, err := executeCFNamespaceTemplate(tmpl, example); err != nil {
+		return nil, errors.Wrap(err, "invalid Cloud Foundry namespace template")
+	}
+	return tmpl, nil
+}
+
+func executeCFNamespaceTemplate(tmpl *template.Template, data cfNamespace) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	namespace := strings.ToLower(strings.TrimSpace(buf.String()))
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return "", errors.Errorf("%q is not a valid namespace: %s", namespace, strings.Join(errs, ", "))
+	}
+	return namespace, nil
+}
+
+// resolveNamespace returns the namespace an instance is provisioned into,
+// and whether minibroker creates it when it does not exist. The instances of
+// a Cloud Foundry space are kept in a namespace of their own when a template
+// names them, which is created with the first of them, and the instances of
+// Kubernetes platforms in the namespace they are requested from. The default
+// namespace is used otherwise, or always when it is forced.
+func (b *Broker) resolveNamespace(c requestContext) (string, bool, error) {
+	if b.forceNamespace {
+		return b.defaultNamespace, false, nil
+	}
+	if c.Platform == minibroker.PlatformCloudFoundry && b.cfNamespaceTemplate != nil {
+		if c.OrganizationGUID == "" || c.SpaceGUID == "" {
+			return "", false, invalidContext("organization_guid and space_guid are required")
+		}
+		namespace, err := executeCFNamespaceTemplate(b.cfNamespaceTemplate, cfNamespace{
+			OrganizationGUID: c.OrganizationGUID,
+			SpaceGUID:        c.SpaceGUID,
+		})
+		return namespace, err == nil, err
+	}
+	if c.Namespace != "" {
+		return c.Namespace, false, nil
+	}
+	return b.defaultNamespace, false, nil
+}
+
+func invalidContext(reason string) error {
+	msg := fmt.Sprintf("invalid context: %s", reason)
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &msg,
+	}
+}
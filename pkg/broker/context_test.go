@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"net/http"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func TestParseContext(t *testing.T) {
+	tests := []struct {
+		context  map[string]interface{}
+		expected requestContext
+		valid    bool
+	}{
+		{nil, requestContext{}, true},
+		{
+			map[string]interface{}{"platform": "kubernetes", "namespace": "team-a", "clusterid": "1234"},
+			requestContext{Platform: "kubernetes", Namespace: "team-a"},
+			true,
+		},
+		{
+			map[string]interface{}{"platform": "cloudfoundry", "organization_guid": "org", "space_guid": "space"},
+			requestContext{Platform: "cloudfoundry", OrganizationGUID: "org", SpaceGUID: "space"},
+			true,
+		},
+		{map[string]interface{}{"namespace": nil}, requestContext{}, true},
+		{map[string]interface{}{"namespace": 42.0}, requestContext{}, false},
+		{map[string]interface{}{"namespace": map[string]interface{}{"name": "team-a"}}, requestContext{}, false},
+		{map[string]interface{}{"platform": true}, requestContext{}, false},
+	}
+	for _, tt := range tests {
+		actual, err := parseContext(tt.context)
+		if !tt.valid {
+			if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusBadRequest {
+				t.Errorf("parseContext(%v): expected a 400, got %v", tt.context, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseContext(%v): unexpected error %v", tt.context, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("parseContext(%v): expected %+v, actual %+v", tt.context, tt.expected, actual)
+		}
+	}
+}
+
+func TestResolveNamespace(t *testing.T) {
+	cfTemplate, err := parseCFNamespaceTemplate("cf-{{.SpaceGUID}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubernetes := requestContext{Platform: "kubernetes", Namespace: "team-a"}
+	cf := requestContext{
+		Platform:         "cloudfoundry",
+		OrganizationGUID: "5A2E3B1C-0D4F-4E6A-8B7C-9D0E1F2A3B4C",
+		SpaceGUID:        "6B3F4C2D-1E5A-4F7B-9C8D-0E1F2A3B4C5D",
+	}
+
+	tests := []struct {
+		name     string
+		broker   *Broker
+		context  requestContext
+		expected string
+		created  bool
+		valid    bool
+	}{
+		{"kubernetes", &Broker{defaultNamespace: "minibroker"}, kubernetes, "team-a", false, true},
+		{"no namespace", &Broker{defaultNamespace: "minibroker"}, requestContext{}, "minibroker", false, true},
+		{"forced", &Broker{defaultNamespace: "minibroker", forceNamespace: true}, kubernetes, "minibroker", false, true},
+		{"cf without template", &Broker{defaultNamespace: "minibroker"}, cf, "minibroker", false, true},
+		{"cf", &Broker{cfNamespaceTemplate: cfTemplate}, cf, "cf-6b3f4c2d-1e5a-4f7b-9c8d-0e1f2a3b4c5d", true, true},
+		{"cf without space", &Broker{cfNamespaceTemplate: cfTemplate}, requestContext{Platform: "cloudfoundry", OrganizationGUID: "org"}, "", false, false},
+	}
+	for _, tt := range tests {
+		actual, created, err := tt.broker.resolveNamespace(tt.context)
+		if tt.valid != (err == nil) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("%s: expected namespace %q, actual %q", tt.name, tt.expected, actual)
+		}
+		if created != tt.created {
+			t.Errorf("%s: expected created %t, actual %t", tt.name, tt.created, created)
+		}
+	}
+
+	for _, text := range []string{"cf-{{.SpaceGUID}}-{{.OrganizationGUID}}", "{{.Space}}", "cf_{{.SpaceGUID}}"} {
+		if _, err := parseCFNamespaceTemplate(text); err == nil {
+			t.Errorf("parseCFNamespaceTemplate(%q): expected an invalid template error", text)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/kubernetes-sigs/minibroker/pkg/minibroker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// keyedLock allows a single operation at a time for every key, without
+// operations on different keys waiting for each other. Operations that only
+// need the key to stay around, e.g. binding an instance, may share it.
+type keyedLock struct {
+	mutex sync.Mutex
+	// held counts the shared holders of every key, or is exclusiveHold
+	held map[string]int
+}
+
+const exclusiveHold = -1
+
+func newKeyedLock() *keyedLock {
+	return &keyedLock{held: map[string]int{}}
+}
+
+// tryLock acquires the lock for key; it returns false, without blocking, if
+// the lock is already held.
+func (l *keyedLock) tryLock(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.held[key]; ok {
+		return false
+	}
+	l.held[key] = exclusiveHold
+	return true
+}
+
+// unlock releases the lock for key.
+func (l *keyedLock) unlock(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.held, key)
+}
+
+// tryRLock acquires the lock for key shared with other tryRLock callers; it
+// returns false, without blocking, if the lock is held by tryLock.
+func (l *keyedLock) tryRLock(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.held[key] == exclusiveHold {
+		return false
+	}
+	l.held[key]++
+	return true
+}
+
+// runlock releases a shared lock for key.
+func (l *keyedLock) runlock(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.held[key] <= 1 {
+		delete(l.held, key)
+		return
+	}
+	l.held[key]--
+}
+
+// operationLocks synchronizes the operations on instances and bindings.
+// Binds and unbinds share the lock of their instance, so that they only
+// exclude the operations changing the instance.
+type operationLocks struct {
+	instances *keyedLock
+	bindings  *keyedLock
+}
+
+var _ minibroker.OperationLocks = &operationLocks{}
+
+func newOperationLocks() *operationLocks {
+	return &operationLocks{
+		instances: newKeyedLock(),
+		bindings:  newKeyedLock(),
+	}
+}
+
+func (l *operationLocks) LockInstance(instanceID string) (func(), bool) {
+	if !l.instances.tryLock(instanceID) {
+		return nil, false
+	}
+	return func() { l.instances.unlock(instanceID) }, true
+}
+
+func (l *operationLocks) LockBinding(instanceID, bindingID string) (func(), bool) {
+	if !l.instances.tryRLock(instanceID) {
+		return nil, false
+	}
+	if !l.bindings.tryLock(bindingID) {
+		l.instances.runlock(instanceID)
+		return nil, false
+	}
+	return func() {
+		l.bindings.unlock(bindingID)
+		l.instances.runlock(instanceID)
+	}, true
+}
+
+// concurrencyError is returned when another operation on the same instance, or
+// binding, is still being handled.
+func concurrencyError() error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:   http.StatusUnprocessableEntity,
+		ErrorMessage: &[]string{minibroker.ConcurrencyErrorMessage}[0],
+		Description:  &[]string{minibroker.ConcurrencyErrorDescription}[0],
+	}
+}
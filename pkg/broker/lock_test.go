@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestKeyedLock(t *testing.T) {
+	l := newKeyedLock()
+
+	if !l.tryLock("foo") {
+		t.Fatalf("tryLock(foo): expected to acquire a free lock")
+	}
+	if l.tryLock("foo") {
+		t.Errorf("tryLock(foo): expected to fail on a held lock")
+	}
+	if !l.tryLock("bar") {
+		t.Errorf("tryLock(bar): expected not to be blocked by foo")
+	}
+
+	l.unlock("foo")
+	if !l.tryLock("foo") {
+		t.Errorf("tryLock(foo): expected to acquire a released lock")
+	}
+}
+
+func TestKeyedLockShared(t *testing.T) {
+	l := newKeyedLock()
+
+	if !l.tryRLock("foo") || !l.tryRLock("foo") {
+		t.Fatalf("tryRLock(foo): expected to share the lock")
+	}
+	if l.tryLock("foo") {
+		t.Errorf("tryLock(foo): expected to fail on a shared lock")
+	}
+
+	l.runlock("foo")
+	if l.tryLock("foo") {
+		t.Errorf("tryLock(foo): expected to fail while the lock is still shared")
+	}
+	l.runlock("foo")
+	if !l.tryLock("foo") {
+		t.Fatalf("tryLock(foo): expected to acquire a released lock")
+	}
+	if l.tryRLock("foo") {
+		t.Errorf("tryRLock(foo): expected to fail on a held lock")
+	}
+}
+
+func TestOperationLocks(t *testing.T) {
+	l := newOperationLocks()
+
+	unbindA, ok := l.LockBinding("instance", "a")
+	if !ok {
+		t.Fatalf("LockBinding(instance, a): expected to acquire a free lock")
+	}
+	unbindB, ok := l.LockBinding("instance", "b")
+	if !ok {
+		t.Fatalf("LockBinding(instance, b): expected not to be blocked by binding a")
+	}
+	if _, ok := l.LockBinding("instance", "a"); ok {
+		t.Errorf("LockBinding(instance, a): expected to fail on a held lock")
+	}
+	if _, ok := l.LockInstance("instance"); ok {
+		t.Errorf("LockInstance(instance): expected to fail while bindings are locked")
+	}
+
+	unbindA()
+	unbindB()
+	unlock, ok := l.LockInstance("instance")
+	if !ok {
+		t.Fatalf("LockInstance(instance): expected to acquire a released lock")
+	}
+	if _, ok := l.LockBinding("instance", "a"); ok {
+		t.Errorf("LockBinding(instance, a): expected to fail while the instance is locked")
+	}
+	unlock()
+	if _, ok := l.LockBinding("instance", "a"); !ok {
+		t.Errorf("LockBinding(instance, a): expected to acquire a released lock")
+	}
+}
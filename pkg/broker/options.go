@@ -1,8 +1,37 @@
 package broker
 
+import (
+	"github.com/kubernetes-sigs/minibroker/pkg/helm"
+	"github.com/kubernetes-sigs/minibroker/pkg/minibroker"
+)
+
 type Options struct {
 	HelmRepoUrl               string
+	HelmRepos                 string
+	HelmReposFile             string
+	HelmBackend               string
+	ChartCache                helm.CacheOptions
+	Tiller                    helm.TillerOptions
+	Auth                      AuthOptions
 	CatalogPath               string
 	DefaultNamespace          string
+	ForceNamespace            bool
+	CFNamespaceTemplate       string
+	Namespaces                minibroker.NamespacePolicy
 	ServiceCatalogEnabledOnly bool
 }
+
+// repositories returns the chart repositories to build the catalog from. The
+// repositories file takes precedence over the list of repositories, which
+// takes precedence over the single repository url.
+func (o Options) repositories() ([]helm.Repository, error) {
+	switch {
+	case o.HelmReposFile != "":
+		return helm.LoadRepositories(o.HelmReposFile)
+	case o.HelmRepos != "":
+		return helm.ParseRepositories(o.HelmRepos)
+	case o.HelmRepoUrl != "":
+		return []helm.Repository{{Name: "stable", URL: o.HelmRepoUrl}}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// apiVersion is a version of the OSB API, as sent by platforms in the
+// X-Broker-API-Version header.
+type apiVersion struct {
+	major, minor int
+}
+
+var (
+	// apiVersion2_13 is the oldest version platforms may use, as minibroker
+	// relies on its schemas and originating identity.
+	apiVersion2_13 = apiVersion{2, 13}
+	// apiVersion2_14 introduced fetching instances and bindings, and
+	// asynchronous bindings.
+	apiVersion2_14 = apiVersion{2, 14}
+	// apiVersion2_15 introduced the maintenance info of plans.
+	apiVersion2_15 = apiVersion{2, 15}
+)
+
+func parseAPIVersion(header string) (apiVersion, error) {
+	parts := strings.Split(strings.TrimSpace(header), ".")
+	if len(parts) == 2 {
+		major, majorErr := strconv.Atoi(parts[0])
+		minor, minorErr := strconv.Atoi(parts[1])
+		if majorErr == nil && minorErr == nil {
+			return apiVersion{major, minor}, nil
+		}
+	}
+	return apiVersion{}, errors.Errorf("invalid version %q", header)
+}
+
+func (v apiVersion) atLeast(other apiVersion) bool {
+	return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// requestAPIVersion returns the version of the OSB API a request was made
+// with, once validated by ValidateBrokerAPIVersion.
+func requestAPIVersion(r *http.Request) apiVersion {
+	v, err := parseAPIVersion(r.Header.Get(osb.APIVersionHeader))
+	if err != nil {
+		return apiVersion2_13
+	}
+	return v
+}
+
+// requireAPIVersion rejects requests made with a version older than the one
+// that introduced a feature.
+func requireAPIVersion(r *http.Request, required apiVersion, feature string) error {
+	if requestAPIVersion(r).atLeast(required) {
+		return nil
+	}
+	msg := fmt.Sprintf("%s requires version %s of the OSB API, got %s", feature, required, r.Header.Get(osb.APIVersionHeader))
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusPreconditionFailed,
+		Description: &msg,
+	}
+}
+
+// ValidateBrokerAPIVersion accepts the 2.x versions of the OSB API from 2.13
+// on. Features of newer versions are only offered to the platforms that use
+// them.
+func (b *Broker) ValidateBrokerAPIVersion(version string) error {
+	v, err := parseAPIVersion(version)
+	if err == nil && v.major == apiVersion2_13.major && v.atLeast(apiVersion2_13) {
+		return nil
+	}
+	msg := fmt.Sprintf("unsupported OSB API version %q, minibroker supports 2.x from %s on", version, apiVersion2_13)
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusPreconditionFailed,
+		Description: &msg,
+	}
+}
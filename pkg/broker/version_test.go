@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/metrics"
+)
+
+func TestValidateBrokerAPIVersion(t *testing.T) {
+	b := &Broker{}
+	tests := []struct {
+		version string
+		wantErr bool
+	}{
+		{"2.13", false},
+		{"2.14", false},
+		{"2.15", false},
+		{"2.17", false},
+		{"2.12", true},
+		{"2.11", true},
+		{"3.0", true},
+		{"1.14", true},
+		{"", true},
+		{"2", true},
+		{"2.x", true},
+	}
+	for _, tt := range tests {
+		err := b.ValidateBrokerAPIVersion(tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateBrokerAPIVersion(%q): got error %v, expected error: %t", tt.version, err, tt.wantErr)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("ValidateBrokerAPIVersion(%q): expected a 412, got %v", tt.version, err)
+		}
+	}
+}
+
+func TestFetchRequiresAPIVersion2_14(t *testing.T) {
+	router := NewRouter(&Broker{}, metrics.New(), http.NotFoundHandler())
+	for _, path := range []string{
+		"/v2/service_instances/instance",
+		"/v2/service_instances/instance/service_bindings/binding",
+		"/v2/service_instances/instance/service_bindings/binding/last_operation",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(osb.APIVersionHeader, "2.13")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("GET %s with version 2.13: got status %d, expected %d", path, rec.Code, http.StatusPreconditionFailed)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package helm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Keys of the secret mounted at the SecretDir of a repository.
+const (
+	secretUsernameKey = "username"
+	secretPasswordKey = "password"
+	secretTokenKey    = "token"
+	secretCAKey       = "ca.crt"
+)
+
+// credentials authenticate the requests to a repository.
+type credentials struct {
+	username string
+	password string
+	token    string
+	caBundle []byte
+}
+
+// credentials reads the credentials of the repository from its secret. They
+// are read on every use so that rotated secrets are picked up.
+func (r Repository) credentials() (credentials, error) {
+	var creds credentials
+	if r.SecretDir == "" {
+		return creds, nil
+	}
+
+	read := func(key string) ([]byte, error) {
+		data, err := ioutil.ReadFile(filepath.Join(r.SecretDir, key))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the %s of repository %q", key, r.Name)
+		}
+		return data, nil
+	}
+
+	username, err := read(secretUsernameKey)
+	if err != nil {
+		return creds, err
+	}
+	password, err := read(secretPasswordKey)
+	if err != nil {
+		return creds, err
+	}
+	token, err := read(secretTokenKey)
+	if err != nil {
+		return creds, err
+	}
+	creds.caBundle, err = read(secretCAKey)
+	if err != nil {
+		return creds, err
+	}
+	creds.username = strings.TrimSpace(string(username))
+	creds.password = strings.TrimSpace(string(password))
+	creds.token = strings.TrimSpace(string(token))
+	return creds, nil
+}
+
+func (c credentials) authorize(req *http.Request) {
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.username != "" || c.password != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+func (c credentials) httpClient() (*http.Client, error) {
+	if c.caBundle == nil {
+		return http.DefaultClient, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(c.caBundle) {
+		return nil, errors.New("no certificate found in the CA bundle")
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// host returns the host of the repository, which requests are only
+// authenticated to.
+func (r Repository) host() string {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// get requests a URL of the repository. Credentials are only sent to the
+// host of the repository, and exchanged for a token when a registry asks for
+// one.
+func (c *Client) get(r Repository, rawURL string, header http.Header) (*http.Response, error) {
+	creds, err := r.credentials()
+	if err != nil {
+		return nil, err
+	}
+	client, err := creds.httpClient()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CA bundle for repository %q", r.Name)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if req.URL.Host != r.host() {
+		return client.Do(req)
+	}
+	creds.authorize(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(challenge, "Bearer ") {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	token, err := fetchToken(client, challenge, creds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not authenticate to repository %q", r.Name)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return client.Do(req)
+}
+
+// challengeParam matches the parameters of a WWW-Authenticate header.
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken exchanges credentials for the token a registry asks for, as in
+// the Docker registry token authentication.
+func fetchToken(client *http.Client, challenge string, creds credentials) (string, error) {
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", errors.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value := params[key]; value != "" {
+			query.Set(key, value)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if creds.username != "" || creds.password != "" {
+		req.SetBasicAuth(creds.username, creds.password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("got status code %d from %s", resp.StatusCode, realm.Host)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "could not parse the token")
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("no token returned")
+}
@@ -0,0 +1,182 @@
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
+)
+
+// digestPattern matches the sha256 digests listed in repository indexes.
+var digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// CacheOptions configures where charts are kept and fetched from.
+type CacheOptions struct {
+	// Dir keeps the downloaded charts by digest. Defaults to a directory in
+	// the helm home.
+	Dir string
+	// Offline serves indexes and charts only from the cache and from
+	// repositories with a file:// URL, for clusters without internet access
+	Offline bool
+	// RefreshInterval is how often the indexes are checked for new charts.
+	// They are only downloaded once when zero.
+	RefreshInterval time.Duration
+	// Keyring is the path of the public keyring the provenance of charts is
+	// verified with, for the repositories that verify it
+	Keyring string
+}
+
+func (c *Client) cacheDir() string {
+	if c.cache.Dir != "" {
+		return c.cache.Dir
+	}
+	return filepath.Join(c.home.Cache(), "charts")
+}
+
+// cachePath returns where the chart with the given digest is cached.
+func (c *Client) cachePath(digest string) string {
+	return filepath.Join(c.cacheDir(), "sha256", digest+".tgz")
+}
+
+// LoadChart loads a chart version. Charts are verified against the digest of
+// the index, and kept in the cache by digest so that each is downloaded once.
+// Their provenance is then verified according to the policy of their
+// repository.
+func (c *Client) LoadChart(cv *ChartVersion) (*chart.Chart, error) {
+	if len(cv.URLs) == 0 {
+		return nil, errors.Errorf("chart %s-%s has no url", cv.Name, cv.Version)
+	}
+
+	path, cleanup, err := c.chartArchive(cv)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err := c.verify(cv, path); err != nil {
+		return nil, err
+	}
+
+	glog.Infof("loading chart from %s on disk", path)
+	return chartutil.Load(path)
+}
+
+// chartArchive returns the path of the archive of a chart version, and a
+// function removing it when it is not kept.
+func (c *Client) chartArchive(cv *ChartVersion) (string, func(), error) {
+	keep := func() {}
+	chartURL := cv.URLs[0]
+
+	if u, err := url.Parse(chartURL); err == nil && u.Scheme == "file" {
+		if err := checkDigest(u.Path, cv.Digest); err != nil {
+			return "", nil, err
+		}
+		return u.Path, keep, nil
+	}
+
+	if cv.Digest == "" {
+		if c.cache.Offline {
+			return "", nil, errors.Errorf("chart %s-%s has no digest to find it in the cache with", cv.Name, cv.Version)
+		}
+		glog.Warningf("chart %s-%s has no digest, it is neither verified nor cached", cv.Name, cv.Version)
+		path, _, err := c.fetch(cv.Repository, chartURL)
+		if err != nil {
+			return "", nil, err
+		}
+		return path, func() { os.Remove(path) }, nil
+	}
+	if !digestPattern.MatchString(cv.Digest) {
+		return "", nil, errors.Errorf("chart %s-%s has an invalid digest %q", cv.Name, cv.Version, cv.Digest)
+	}
+
+	cached := c.cachePath(cv.Digest)
+	if _, err := os.Stat(cached); err == nil {
+		if err := checkDigest(cached, cv.Digest); err == nil {
+			glog.Infof("found chart %s-%s in the cache", cv.Name, cv.Version)
+			return cached, keep, nil
+		}
+		glog.Errorf("Discarding the cached chart %s: %s", cached, err)
+		os.Remove(cached)
+	}
+
+	if c.cache.Offline {
+		return "", nil, errors.Errorf("chart %s-%s is not cached and minibroker is offline", cv.Name, cv.Version)
+	}
+
+	path, digest, err := c.fetch(cv.Repository, chartURL)
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(path)
+	if digest != cv.Digest {
+		return "", nil, errors.Errorf("chart downloaded from %s has digest %s, expected %s", chartURL, digest, cv.Digest)
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return "", nil, errors.Wrap(err, "failed to create the chart cache directory")
+	}
+	if err := os.Rename(path, cached); err != nil {
+		return "", nil, errors.Wrapf(err, "failed to cache chart at %s", cached)
+	}
+	return cached, keep, nil
+}
+
+// fetch downloads a chart from a repository to a temporary file in the cache
+// directory and returns its path and digest. The caller removes the file.
+func (c *Client) fetch(r Repository, chartURL string) (string, string, error) {
+	glog.Infof("downloading chart from %s", chartURL)
+	resp, err := c.get(r, chartURL, nil)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to download chart from %s", chartURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.Errorf("got status code %d trying to download chart at %s", resp.StatusCode, chartURL)
+	}
+
+	if err := os.MkdirAll(c.cacheDir(), 0755); err != nil {
+		return "", "", errors.Wrap(err, "failed to create the chart cache directory")
+	}
+	fd, err := ioutil.TempFile(c.cacheDir(), "download-")
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to create temp chart file")
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fd, h), resp.Body)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", "", errors.Wrapf(err, "failed to copy chart contents to %s", fd.Name())
+	}
+	return fd.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkDigest checks the digest of a chart archive, when given.
+func checkDigest(path, digest string) error {
+	if digest == "" {
+		return nil
+	}
+	actual, err := provenance.DigestFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to compute the digest of %s", path)
+	}
+	if actual != digest {
+		return errors.Errorf("chart %s has digest %s, expected %s", path, actual, digest)
+	}
+	return nil
+}
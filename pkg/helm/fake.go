@@ -0,0 +1,99 @@
+package helm
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// FakeReleaseManager keeps releases in memory without deploying anything, for
+// use in tests.
+type FakeReleaseManager struct {
+	// Err, when set, is returned by every operation
+	Err error
+
+	mu       sync.Mutex
+	releases map[string]*release.Release
+}
+
+func NewFakeReleaseManager() *FakeReleaseManager {
+	return &FakeReleaseManager{releases: map[string]*release.Release{}}
+}
+
+func (m *FakeReleaseManager) InstallRelease(ch *chart.Chart, name, namespace string, values []byte, wait bool) (*release.Release, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	version := int32(1)
+	if previous, ok := m.releases[name]; ok {
+		if previous.GetInfo().GetStatus().GetCode() == release.Status_DEPLOYED {
+			return nil, errors.Errorf("release %s already exists", name)
+		}
+		version = previous.Version + 1
+	}
+	rel := fakeRelease(ch, name, namespace, version, values)
+	m.releases[name] = rel
+	return rel, nil
+}
+
+func (m *FakeReleaseManager) UpgradeRelease(name string, ch *chart.Chart, values []byte, wait bool) (*release.Release, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	previous, ok := m.releases[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrReleaseNotFound, "release %s", name)
+	}
+	rel := fakeRelease(ch, name, previous.Namespace, previous.Version+1, values)
+	m.releases[name] = rel
+	return rel, nil
+}
+
+func (m *FakeReleaseManager) DeleteRelease(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+
+	if _, ok := m.releases[name]; !ok {
+		return errors.Wrapf(ErrReleaseNotFound, "release %s", name)
+	}
+	delete(m.releases, name)
+	return nil
+}
+
+func (m *FakeReleaseManager) GetRelease(name string) (*release.Release, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	rel, ok := m.releases[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrReleaseNotFound, "release %s", name)
+	}
+	return rel, nil
+}
+
+func fakeRelease(ch *chart.Chart, name, namespace string, version int32, values []byte) *release.Release {
+	return &release.Release{
+		Name:      name,
+		Namespace: namespace,
+		Version:   version,
+		Chart:     ch,
+		Config:    &chart.Config{Raw: string(values)},
+		Info: &release.Info{
+			Status: &release.Status{Code: release.Status_DEPLOYED},
+		},
+	}
+}
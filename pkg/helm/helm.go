@@ -2,36 +2,138 @@ package helm
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
-	"net/http"
-	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
-	"k8s.io/helm/pkg/chartutil"
-	"k8s.io/helm/pkg/getter"
 	"k8s.io/helm/pkg/helm/environment"
 	"k8s.io/helm/pkg/helm/helmpath"
-	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/repo"
 )
 
-const stableURL = "https://kubernetes-charts.storage.googleapis.com"
+const (
+	stableName = "stable"
+	stableURL  = "https://kubernetes-charts.storage.googleapis.com"
+
+	// repoSeparator joins the name of a repository and of a chart into the
+	// name of a service, when several repositories have a chart with that name
+	repoSeparator = "."
+)
+
+// Repository is a chart repository the catalog is built from.
+type Repository struct {
+	Name string `json:"name"`
+	// URL is the URL of a chart repository, or oci://<registry>/<path> for
+	// charts pushed to an OCI registry as <path>/<chart>:<version>
+	URL string `json:"url"`
+	// SecretDir is where a secret with the credentials of the repository is
+	// mounted. Its optional keys are username and password for basic
+	// authentication, token for bearer authentication and ca.crt for the CA
+	// bundle verifying the repository.
+	SecretDir string `json:"secretDir,omitempty"`
+	// Charts are the charts offered from an OCI registry, which cannot list
+	// them
+	Charts []string `json:"charts,omitempty"`
+	// Verify is the policy for verifying the provenance of the charts: off,
+	// warn or enforce. Defaults to off.
+	Verify string `json:"verify,omitempty"`
+}
 
 type Client struct {
-	repoURL string
-	home    helmpath.Home
-	rf      *repo.RepoFile
+	repos []Repository
+	home  helmpath.Home
+	cache CacheOptions
+
+	// validators of the cached indexes, by repository
+	mu         sync.Mutex
+	validators map[string]indexValidators
+}
+
+// NewClient returns a client for the given repositories, in order of
+// precedence. Without repositories, the stable repository is used.
+func NewClient(repos []Repository, cache CacheOptions) (*Client, error) {
+	if len(repos) == 0 {
+		repos = []Repository{{Name: stableName, URL: stableURL}}
+	}
+
+	names := map[string]bool{}
+	for _, r := range repos {
+		if r.Name == "" || strings.Contains(r.Name, repoSeparator) {
+			return nil, errors.Errorf("invalid repository name %q", r.Name)
+		}
+		if names[r.Name] {
+			return nil, errors.Errorf("repository %q is defined more than once", r.Name)
+		}
+		if r.URL == "" {
+			return nil, errors.Errorf("repository %q has no url", r.Name)
+		}
+		if r.isOCI() && len(r.Charts) == 0 {
+			return nil, errors.Errorf("OCI repository %q lists no charts", r.Name)
+		}
+		if !validVerifyPolicy(r.Verify) {
+			return nil, errors.Errorf("invalid verify policy %q for repository %q", r.Verify, r.Name)
+		}
+		if r.Verify != "" && r.Verify != VerifyOff && cache.Keyring == "" {
+			return nil, errors.Errorf("repository %q is verified but no keyring is configured", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	return &Client{
+		repos:      repos,
+		cache:      cache,
+		validators: map[string]indexValidators{},
+	}, nil
+}
+
+// ParseRepositories parses a comma separated list of name=url pairs.
+func ParseRepositories(list string) ([]Repository, error) {
+	var repos []Repository
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid repository %q, expected name=url", item)
+		}
+		repos = append(repos, Repository{Name: parts[0], URL: parts[1]})
+	}
+	return repos, nil
 }
 
-func NewClient(repoURL string) *Client {
-	if repoURL == "" {
-		repoURL = stableURL
+// LoadRepositories reads the repositories from a file using the same format
+// as the helm repositories.yaml file.
+func LoadRepositories(path string) ([]Repository, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read repositories file %s", path)
 	}
 
-	return &Client{repoURL: repoURL}
+	var f struct {
+		Repositories []Repository `json:"repositories"`
+	}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, errors.Wrapf(err, "could not parse repositories file %s", path)
+	}
+	return f.Repositories, nil
+}
+
+// ChartName returns the name of the chart a service is made of, which is
+// only qualified by the name of its repository when another repository has a
+// chart with the same name. Chart names may contain dots themselves.
+func (c *Client) ChartName(serviceName string) string {
+	for _, r := range c.repos {
+		if strings.HasPrefix(serviceName, r.Name+repoSeparator) {
+			return strings.TrimPrefix(serviceName, r.Name+repoSeparator)
+		}
+	}
+	return serviceName
 }
 
 func (c *Client) Init() error {
@@ -42,107 +144,123 @@ func (c *Client) Init() error {
 		return err
 	}
 
-	cif := c.home.CacheIndex("stable")
-	cr := repo.Entry{
-		Name:  "stable",
-		Cache: cif,
-		URL:   c.repoURL,
+	for _, r := range c.repos {
+		if err := c.updateIndex(r); err != nil {
+			return err
+		}
+
+		f.Update(&repo.Entry{
+			Name:  r.Name,
+			Cache: c.indexPath(r.Name),
+			URL:   r.URL,
+		})
 	}
 
-	var settings environment.EnvSettings
-	r, err := repo.NewChartRepository(&cr, getter.All(settings))
-	if err != nil {
+	if err := f.WriteFile(c.home.RepositoryFile(), 0644); err != nil {
 		return err
 	}
 
-	if err := r.DownloadIndexFile(c.home.Cache()); err != nil {
-		return errors.Wrapf(err, "Looks like %q is not a valid chart repository or cannot be reached", cr.URL)
+	if c.cache.RefreshInterval > 0 {
+		go c.refreshPeriodically(c.cache.RefreshInterval)
 	}
+	return nil
+}
 
-	f.Update(&cr)
-	f.WriteFile(c.home.RepositoryFile(), 0644)
+// indexPath returns where the index of a repository is cached. Indexes are
+// kept along with the charts when the cache directory is set, so that they
+// are still available offline after a restart.
+func (c *Client) indexPath(name string) string {
+	if c.cache.Dir == "" {
+		return c.home.CacheIndex(name)
+	}
+	return filepath.Join(c.cache.Dir, "indexes", name+"-index.yaml")
+}
 
-	// Load the repositories.yaml
-	c.rf, err = repo.LoadRepositoriesFile(c.home.RepositoryFile())
-	return err
+// repoCharts holds the versions of a chart along with the repository they
+// come from.
+type repoCharts struct {
+	repo     Repository
+	versions repo.ChartVersions
 }
 
-func (c *Client) ListCharts() (map[string]repo.ChartVersions, error) {
-	charts := map[string]repo.ChartVersions{}
+// loadCharts returns the charts of all repositories by service name. A chart
+// keeps its own name in the first repository that has it; the same chart in
+// the following repositories is qualified by the repository name.
+func (c *Client) loadCharts() (map[string]repoCharts, error) {
+	charts := map[string]repoCharts{}
 
-	// TODO: handle non-unique names across repos
-	for _, r := range c.rf.Repositories {
-		n := r.Name
-		f := c.home.CacheIndex(n)
+	for _, r := range c.repos {
+		f := c.indexPath(r.Name)
 		index, err := repo.LoadIndexFile(f)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Could not load helm repository index at %s", f)
 		}
 
 		for chart, chartVersions := range index.Entries {
-			charts[chart] = chartVersions
+			name := chart
+			if _, taken := charts[name]; taken {
+				name = r.Name + repoSeparator + chart
+			}
+			charts[name] = repoCharts{repo: r, versions: chartVersions}
 		}
 	}
 
 	return charts, nil
 }
 
-func (c *Client) GetChart(name, version string) (*repo.ChartVersion, error) {
-	charts, err := c.ListCharts()
+// ListCharts returns the versions of every chart by service name.
+func (c *Client) ListCharts() (map[string]repo.ChartVersions, error) {
+	charts, err := c.loadCharts()
 	if err != nil {
 		return nil, err
 	}
 
-	versions, ok := charts[name]
-	if !ok {
-		return nil, fmt.Errorf("chart not found: %s", name)
-	}
-
-	for _, v := range versions {
-		if v.AppVersion == version {
-			return v, nil
-		}
+	versions := make(map[string]repo.ChartVersions, len(charts))
+	for name, entry := range charts {
+		versions[name] = entry.versions
 	}
-
-	return nil, fmt.Errorf("version not found: %s @ %s", name, version)
+	return versions, nil
 }
 
-func LoadChart(chart *repo.ChartVersion) (*chart.Chart, error) {
-	chartURL := chart.URLs[0]
+// ChartVersion is a version of a chart along with the repository it comes
+// from.
+type ChartVersion struct {
+	*repo.ChartVersion
+	Repository Repository
+}
 
-	glog.Infof("downloading chart from %s", chartURL)
-	resp, err := http.Get(chartURL)
+// GetChart returns the given version of a chart.
+func (c *Client) GetChart(name, version string) (*ChartVersion, error) {
+	charts, err := c.loadCharts()
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to download chart from %s", chartURL)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		err = errors.Errorf("got status code %d trying to download chart at %s", resp.StatusCode, chartURL)
 		return nil, err
 	}
-	tmpDir, err := ioutil.TempDir("", "helm")
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create temp helm chart directory")
-	}
 
-	fullChartPath := filepath.Join(tmpDir, "chart")
-	fd, err := os.Create(fullChartPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create temp chart file")
+	entry, ok := charts[name]
+	if !ok {
+		return nil, fmt.Errorf("chart not found: %s", name)
 	}
-	defer func() {
-		if err := fd.Close(); err != nil {
-			glog.Errorln(
-				errors.Wrapf(err, "failed to close file descriptor for chart at %s", fullChartPath))
-		}
-	}()
 
-	glog.Infof("copying chart to %s", fullChartPath)
-	if _, err := io.Copy(fd, resp.Body); err != nil {
-		return nil, errors.Wrapf(err, "failed to copy chart contents to %s", fullChartPath)
+	for _, v := range entry.versions {
+		if v.Version == version {
+			return resolveChartURLs(entry.repo, v)
+		}
 	}
 
-	glog.Infof("loading chart from %s on disk", fullChartPath)
-	return chartutil.Load(fullChartPath)
+	return nil, fmt.Errorf("version not found: %s @ %s", name, version)
+}
+
+// resolveChartURLs returns a copy of the chart version whose URLs are
+// absolute, as indexes may list them relative to the repository.
+func resolveChartURLs(r Repository, v *repo.ChartVersion) (*ChartVersion, error) {
+	resolved := *v
+	resolved.URLs = make([]string, 0, len(v.URLs))
+	for _, u := range v.URLs {
+		abs, err := repo.ResolveReferenceURL(r.URL, u)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid url for chart %s in repository %q", v.Name, r.Name)
+		}
+		resolved.URLs = append(resolved.URLs, abs)
+	}
+	return &ChartVersion{ChartVersion: &resolved, Repository: r}, nil
 }
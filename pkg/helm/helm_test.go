@@ -0,0 +1,439 @@
+package helm
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/helm/helmpath"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestParseRepositories(t *testing.T) {
+	repos, err := ParseRepositories("stable=https://example.com/stable, mirror=https://example.com/mirror,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Repository{
+		{Name: "stable", URL: "https://example.com/stable"},
+		{Name: "mirror", URL: "https://example.com/mirror"},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("expected %v, got %v", expected, repos)
+	}
+
+	if _, err := ParseRepositories("https://example.com/stable"); err == nil {
+		t.Error("expected an error for a repository without a name")
+	}
+}
+
+func TestNewClientValidatesRepositories(t *testing.T) {
+	testcases := [][]Repository{
+		{{Name: "my.repo", URL: "https://example.com"}},
+		{{Name: "repo", URL: ""}},
+		{{Name: "repo", URL: "https://example.com/a"}, {Name: "repo", URL: "https://example.com/b"}},
+	}
+
+	for _, repos := range testcases {
+		if _, err := NewClient(repos, CacheOptions{}); err == nil {
+			t.Errorf("expected an error for repositories %v", repos)
+		}
+	}
+}
+
+func TestGetChartFromSeveralRepositories(t *testing.T) {
+	home, err := ioutil.TempDir("", "minibroker-helm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	c, err := NewClient([]Repository{
+		{Name: "stable", URL: "https://example.com/stable"},
+		{Name: "mirror", URL: "https://example.com/mirror/"},
+	}, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.home = helmpath.Home(home)
+
+	writeIndex(t, c.home.CacheIndex("stable"), "mysql", "1.0.0")
+	writeIndex(t, c.home.CacheIndex("mirror"), "mysql", "2.0.0")
+
+	charts, err := c.ListCharts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(charts) != 2 || charts["mysql"] == nil || charts["mirror.mysql"] == nil {
+		t.Fatalf("expected mysql and mirror.mysql, got %v", charts)
+	}
+
+	chart, err := c.GetChart("mirror.mysql", "2.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chart.Version != "2.0.0" || chart.URLs[0] != "https://example.com/mirror/mysql-2.0.0.tgz" {
+		t.Errorf("got chart %s from %v", chart.Version, chart.URLs)
+	}
+	if c.ChartName("mirror.mysql") != "mysql" || c.ChartName("mysql") != "mysql" {
+		t.Error("expected the chart name to be mysql")
+	}
+	if name := c.ChartName("socket.io"); name != "socket.io" {
+		t.Errorf("expected the chart name to be socket.io, got %s", name)
+	}
+}
+
+func TestLoadChartFromCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minibroker-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{Name: "db", Version: "1.0.0"},
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := provenance.DigestFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(nil, CacheOptions{Dir: filepath.Join(dir, "cache")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartVersion := func(url, digest string) *ChartVersion {
+		return &ChartVersion{
+			ChartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "db", Version: "1.0.0"},
+				URLs:     []string{url},
+				Digest:   digest,
+			},
+			Repository: Repository{Name: "stable", URL: server.URL},
+		}
+	}
+	cv := chartVersion(server.URL+"/db-1.0.0.tgz", digest)
+
+	for i := 0; i < 2; i++ {
+		ch, err := c.LoadChart(cv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.GetMetadata().GetName() != "db" {
+			t.Errorf("expected chart db, got %s", ch.GetMetadata().GetName())
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("expected the chart to be downloaded once, got %d downloads", downloads)
+	}
+
+	c.cache.Offline = true
+	if _, err := c.LoadChart(cv); err != nil {
+		t.Errorf("expected the cached chart to load offline, got %v", err)
+	}
+	if _, err := c.LoadChart(chartVersion("file://"+archive, digest)); err != nil {
+		t.Errorf("expected a local chart to load offline, got %v", err)
+	}
+	uncached := chartVersion(server.URL+"/db-1.0.0.tgz", strings.Repeat("0", 64))
+	if _, err := c.LoadChart(uncached); err == nil {
+		t.Error("expected an uncached chart to fail offline")
+	}
+
+	c.cache.Offline = false
+	if _, err := c.LoadChart(uncached); err == nil {
+		t.Error("expected a chart with the wrong digest to fail")
+	}
+	files, err := ioutil.ReadDir(c.cacheDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			t.Errorf("expected downloads to be cleaned up, found %s", f.Name())
+		}
+	}
+}
+
+func TestRefreshOnlyDownloadsChangedIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minibroker-refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := indexYAML("mysql", "1.0.0")
+	etag := `"1"`
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(index))
+	}))
+	defer server.Close()
+
+	c, err := NewClient([]Repository{{Name: "stable", URL: server.URL}}, CacheOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("expected an unchanged index to be downloaded once, got %d downloads", downloads)
+	}
+
+	index, etag = indexYAML("mysql", "1.1.0"), `"2"`
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetChart("mysql", "1.1.0"); err != nil {
+		t.Errorf("expected the new chart version to be listed, got %v", err)
+	}
+
+	index, etag = "not: [an index", `"3"`
+	if err := c.Refresh(); err == nil {
+		t.Error("expected an invalid index to fail")
+	}
+	if _, err := c.GetChart("mysql", "1.1.0"); err != nil {
+		t.Errorf("expected the previous index to be kept, got %v", err)
+	}
+}
+
+func TestOCIRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minibroker-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{Name: "db", Version: "1.0.0", AppVersion: "5.7"},
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, err := provenance.DigestFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := []byte(`{"name":"db","version":"1.0.0","appVersion":"5.7"}`)
+	manifest := `{"config":{"mediaType":"` + helmConfigMediaType + `","digest":"sha256:config"},` +
+		`"layers":[{"mediaType":"` + helmChartMediaType + `","digest":"sha256:` + layerDigest + `"}]}`
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token":"registry-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/charts/db/tags/list":
+			w.Write([]byte(`{"tags":["1.0.0","latest"]}`))
+		case "/v2/charts/db/manifests/1.0.0":
+			w.Write([]byte(manifest))
+		case "/v2/charts/db/blobs/sha256:config":
+			w.Write(config)
+		case "/v2/charts/db/blobs/sha256:" + layerDigest:
+			w.Write(layer)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	secretDir := filepath.Join(dir, "secret")
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	for key, value := range map[string][]byte{"username": []byte("user"), "password": []byte("secret\n"), "ca.crt": caBundle} {
+		if err := os.MkdirAll(secretDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(secretDir, key), value, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewClient([]Repository{{
+		Name:      "registry",
+		URL:       "oci://" + server.Listener.Addr().String() + "/charts",
+		SecretDir: secretDir,
+		Charts:    []string{"db"},
+	}}, CacheOptions{Dir: filepath.Join(dir, "cache")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	cv, err := c.GetChart("db", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cv.AppVersion != "5.7" || cv.Digest != layerDigest {
+		t.Errorf("unexpected chart version %+v", cv.ChartVersion)
+	}
+	ch, err := c.LoadChart(cv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.GetMetadata().GetName() != "db" {
+		t.Errorf("expected chart db, got %s", ch.GetMetadata().GetName())
+	}
+
+	if _, err := NewClient([]Repository{{Name: "registry", URL: "oci://example.com/charts"}}, CacheOptions{}); err == nil {
+		t.Error("expected an OCI repository without charts to be rejected")
+	}
+}
+
+func TestVerifyProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minibroker-provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{Name: "db", Version: "1.0.0"},
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := openpgp.NewEntity("platform", "", "platform@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Self-signs the identities of the key, which the keyring needs
+	if err := entity.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	prov, err := (&provenance.Signatory{Entity: entity}).ClearSign(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archive+".prov", []byte(prov), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := os.Create(filepath.Join(dir, "keyring.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(keyring); err != nil {
+		t.Fatal(err)
+	}
+	keyring.Close()
+
+	unsigned, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{Name: "other", Version: "1.0.0"},
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		archive string
+		policy  string
+		valid   bool
+	}{
+		{archive, VerifyEnforce, true},
+		{unsigned, VerifyEnforce, false},
+		{unsigned, VerifyWarn, true},
+		{unsigned, VerifyOff, true},
+	}
+	for _, tc := range testcases {
+		c, err := NewClient([]Repository{{Name: "local", URL: "file://" + dir, Verify: tc.policy}}, CacheOptions{
+			Dir:     filepath.Join(dir, "cache"),
+			Keyring: keyring.Name(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cv := &ChartVersion{
+			ChartVersion: &repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "db", Version: "1.0.0"},
+				URLs:     []string{"file://" + tc.archive},
+			},
+			Repository: c.repos[0],
+		}
+		_, err = c.LoadChart(cv)
+		if tc.valid && err != nil {
+			t.Errorf("expected %s to load with policy %s, got %v", filepath.Base(tc.archive), tc.policy, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected %s to be refused with policy %s", filepath.Base(tc.archive), tc.policy)
+		}
+	}
+
+	if _, err := NewClient([]Repository{{Name: "local", URL: "file://" + dir, Verify: "always"}}, CacheOptions{}); err == nil {
+		t.Error("expected an invalid verify policy to be rejected")
+	}
+	if _, err := NewClient([]Repository{{Name: "local", URL: "file://" + dir, Verify: VerifyWarn}}, CacheOptions{}); err == nil {
+		t.Error("expected a verified repository without a keyring to be rejected")
+	}
+}
+
+func indexYAML(chart, version string) string {
+	return `apiVersion: v1
+entries:
+  ` + chart + `:
+  - name: ` + chart + `
+    version: ` + version + `
+    appVersion: "5.7"
+    urls:
+    - ` + chart + `-` + version + `.tgz
+`
+}
+
+func writeIndex(t *testing.T, path, chart, version string) {
+	index := indexYAML(chart, version)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,138 @@
+package helm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+const (
+	ociScheme = "oci://"
+
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	helmConfigMediaType  = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType   = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// isOCI reports whether the repository is an OCI registry.
+func (r Repository) isOCI() bool {
+	return strings.HasPrefix(r.URL, ociScheme)
+}
+
+// registryURL returns the URL of the registry API for a chart, e.g.
+// https://registry/v2/path/chart for oci://registry/path.
+func (r Repository) registryURL(chartName string) string {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL, ociScheme), "/", 2)
+	name := chartName
+	if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+		name = strings.Trim(parts[1], "/") + "/" + chartName
+	}
+	return fmt.Sprintf("https://%s/v2/%s", parts[0], name)
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// ociIndex builds the index of the charts of a registry, which cannot be
+// listed, from the tags of each chart of the repository. Charts are pointed
+// to by the URL of their blob, and their digest is the one of the blob.
+func (c *Client) ociIndex(r Repository) ([]byte, error) {
+	index := repo.NewIndexFile()
+	for _, name := range r.Charts {
+		base := r.registryURL(name)
+
+		var tags struct {
+			Tags []string `json:"tags"`
+		}
+		if err := c.getJSON(r, base+"/tags/list", "", &tags); err != nil {
+			return nil, errors.Wrapf(err, "could not list the versions of chart %s", name)
+		}
+
+		for _, tag := range tags.Tags {
+			if _, err := semver.NewVersion(tag); err != nil {
+				glog.V(4).Infof("Skipping tag %s of chart %s which is not a version", tag, name)
+				continue
+			}
+			cv, err := c.ociChartVersion(r, base, tag)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not read chart %s:%s", name, tag)
+			}
+			if cv == nil {
+				glog.V(4).Infof("Skipping tag %s of %s which is not a chart", tag, name)
+				continue
+			}
+			index.Entries[cv.Name] = append(index.Entries[cv.Name], cv)
+		}
+	}
+	index.SortEntries()
+	return yaml.Marshal(index)
+}
+
+// ociChartVersion reads the chart pushed with the given tag, or returns nil
+// when the tag is not a chart.
+func (c *Client) ociChartVersion(r Repository, base, tag string) (*repo.ChartVersion, error) {
+	var manifest ociManifest
+	if err := c.getJSON(r, base+"/manifests/"+tag, ociManifestMediaType, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Config.MediaType != helmConfigMediaType {
+		return nil, nil
+	}
+
+	var layer *ociDescriptor
+	for i := range manifest.Layers {
+		if manifest.Layers[i].MediaType == helmChartMediaType {
+			layer = &manifest.Layers[i]
+		}
+	}
+	if layer == nil || !strings.HasPrefix(layer.Digest, "sha256:") {
+		return nil, errors.New("no chart layer found")
+	}
+
+	metadata := &chart.Metadata{}
+	if err := c.getJSON(r, base+"/blobs/"+manifest.Config.Digest, "", metadata); err != nil {
+		return nil, err
+	}
+	return &repo.ChartVersion{
+		Metadata: metadata,
+		URLs:     []string{base + "/blobs/" + layer.Digest},
+		Digest:   strings.TrimPrefix(layer.Digest, "sha256:"),
+	}, nil
+}
+
+func (c *Client) getJSON(r Repository, rawURL, accept string, out interface{}) error {
+	header := http.Header{}
+	if accept != "" {
+		header.Set("Accept", accept)
+	}
+	resp, err := c.get(r, rawURL, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got status code %d trying to get %s", resp.StatusCode, rawURL)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
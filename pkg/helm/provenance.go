@@ -0,0 +1,142 @@
+package helm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/provenance"
+)
+
+// Policies for verifying the provenance of the charts of a repository.
+const (
+	// VerifyOff does not verify charts
+	VerifyOff = "off"
+	// VerifyWarn logs the charts that cannot be verified, and installs them
+	VerifyWarn = "warn"
+	// VerifyEnforce refuses to install the charts that cannot be verified
+	VerifyEnforce = "enforce"
+)
+
+func validVerifyPolicy(policy string) bool {
+	switch policy {
+	case "", VerifyOff, VerifyWarn, VerifyEnforce:
+		return true
+	}
+	return false
+}
+
+// verify checks the provenance of a chart archive according to the policy of
+// its repository.
+func (c *Client) verify(cv *ChartVersion, archive string) error {
+	policy := cv.Repository.Verify
+	if policy == "" || policy == VerifyOff {
+		return nil
+	}
+
+	signedBy, err := c.verifyProvenance(cv, archive)
+	if err == nil {
+		glog.Infof("chart %s-%s is signed by %s", cv.Name, cv.Version, signedBy)
+		return nil
+	}
+	if policy == VerifyWarn {
+		glog.Warningf("Could not verify the provenance of chart %s-%s: %s", cv.Name, cv.Version, err)
+		return nil
+	}
+	return errors.Wrapf(err, "could not verify the provenance of chart %s-%s", cv.Name, cv.Version)
+}
+
+// verifyProvenance checks the .prov file published along with a chart
+// against the keyring, returning who signed it.
+func (c *Client) verifyProvenance(cv *ChartVersion, archive string) (string, error) {
+	if c.cache.Keyring == "" {
+		return "", errors.New("no keyring is configured")
+	}
+	if cv.Repository.isOCI() {
+		return "", errors.New("the provenance of charts from OCI repositories is not supported")
+	}
+	chartURL, err := url.Parse(cv.URLs[0])
+	if err != nil {
+		return "", err
+	}
+
+	// The provenance file lists the archive by the name it was published with
+	dir, err := ioutil.TempDir("", "minibroker-verify")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create temp verification directory")
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Base(chartURL.Path)
+	archive, err = filepath.Abs(archive)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Symlink(archive, filepath.Join(dir, name)); err != nil {
+		return "", errors.Wrap(err, "failed to link the chart archive")
+	}
+
+	prov, err := c.provenanceFile(cv, chartURL)
+	if err != nil {
+		return "", err
+	}
+	provPath := filepath.Join(dir, name+".prov")
+	if err := ioutil.WriteFile(provPath, prov, 0644); err != nil {
+		return "", errors.Wrap(err, "failed to write the provenance file")
+	}
+
+	signatory, err := provenance.NewFromKeyring(c.cache.Keyring, "")
+	if err != nil {
+		return "", errors.Wrapf(err, "could not load keyring %s", c.cache.Keyring)
+	}
+	verification, err := signatory.Verify(filepath.Join(dir, name), provPath)
+	if err != nil {
+		return "", err
+	}
+
+	if cached, _ := filepath.Abs(c.cachePath(cv.Digest)); archive == cached {
+		if err := ioutil.WriteFile(archive+".prov", prov, 0644); err != nil {
+			glog.Errorf("Could not cache the provenance of chart %s-%s: %s", cv.Name, cv.Version, err)
+		}
+	}
+
+	for identity := range verification.SignedBy.Identities {
+		return identity, nil
+	}
+	return "an unnamed key", nil
+}
+
+// provenanceFile returns the provenance file of a chart, from the cache when
+// it was already verified, next to the archive otherwise.
+func (c *Client) provenanceFile(cv *ChartVersion, chartURL *url.URL) ([]byte, error) {
+	if cv.Digest != "" && digestPattern.MatchString(cv.Digest) {
+		if data, err := ioutil.ReadFile(c.cachePath(cv.Digest) + ".prov"); err == nil {
+			return data, nil
+		}
+	}
+
+	provURL := *chartURL
+	provURL.Path += ".prov"
+	if provURL.Scheme == "file" {
+		data, err := ioutil.ReadFile(provURL.Path)
+		return data, errors.Wrap(err, "could not read the provenance file")
+	}
+	if c.cache.Offline {
+		return nil, errors.New("the provenance file is not cached and minibroker is offline")
+	}
+
+	resp, err := c.get(cv.Repository, provURL.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not download the provenance file")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("got status code %d trying to download %s", resp.StatusCode, provURL.String())
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,176 @@
+package helm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/helm/pkg/repo"
+)
+
+// LastRefreshTime is the time the index of each repository was last
+// successfully checked for new charts.
+var LastRefreshTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "minibroker",
+	Name:      "repository_index_last_refresh_timestamp_seconds",
+	Help:      "Unix time of the last successful refresh of the index of a chart repository.",
+}, []string{"repository"})
+
+// indexValidators are the headers of the last index downloaded from a
+// repository, sent back so that it is only downloaded again when it changed.
+type indexValidators struct {
+	etag         string
+	lastModified string
+}
+
+func (c *Client) refreshPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.Refresh(); err != nil {
+			glog.Errorf("Could not refresh the chart repositories: %s", err)
+		}
+	}
+}
+
+// Refresh updates the cached indexes of all repositories. A repository that
+// cannot be reached keeps its previous index.
+func (c *Client) Refresh() error {
+	var failed []string
+	for _, r := range c.repos {
+		if err := c.updateIndex(r); err != nil {
+			glog.Errorf("Could not refresh the index of repository %q: %s", r.Name, err)
+			failed = append(failed, r.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("could not refresh the index of %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// updateIndex caches the index of a repository. Indexes of file://
+// repositories are copied from disk, others are downloaded unless offline or
+// unchanged.
+func (c *Client) updateIndex(r Repository) error {
+	path := c.indexPath(r.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create the index cache directory")
+	}
+
+	if u, err := url.Parse(r.URL); err == nil && u.Scheme == "file" {
+		data, err := ioutil.ReadFile(filepath.Join(u.Path, "index.yaml"))
+		if err != nil {
+			return errors.Wrapf(err, "could not read the index of repository %q", r.Name)
+		}
+		return c.swapIndex(r, path, data, indexValidators{})
+	}
+
+	if c.cache.Offline {
+		if _, err := os.Stat(path); err != nil {
+			return errors.Wrapf(err, "no cached index for repository %q while offline", r.Name)
+		}
+		glog.Infof("Using the cached index of repository %q", r.Name)
+		return nil
+	}
+
+	if r.isOCI() {
+		data, err := c.ociIndex(r)
+		if err != nil {
+			return errors.Wrapf(err, "could not list the charts of OCI repository %q", r.Name)
+		}
+		return c.swapIndex(r, path, data, indexValidators{})
+	}
+
+	data, validators, err := c.downloadIndex(r, path)
+	if err != nil {
+		return errors.Wrapf(err, "Looks like %q is not a valid chart repository or cannot be reached", r.URL)
+	}
+	if data == nil {
+		glog.V(4).Infof("The index of repository %q did not change", r.Name)
+		LastRefreshTime.WithLabelValues(r.Name).Set(float64(time.Now().Unix()))
+		return nil
+	}
+	return c.swapIndex(r, path, data, validators)
+}
+
+// downloadIndex downloads the index of a repository, unless it did not change
+// since it was cached at path, in which case no data is returned.
+func (c *Client) downloadIndex(r Repository, path string) ([]byte, indexValidators, error) {
+	indexURL, err := repo.ResolveReferenceURL(r.URL, "index.yaml")
+	if err != nil {
+		return nil, indexValidators{}, err
+	}
+	header := http.Header{}
+	c.mu.Lock()
+	cached := c.validators[r.Name]
+	c.mu.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		if cached.etag != "" {
+			header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	glog.Infof("downloading the index of repository %q from %s", r.Name, indexURL)
+	resp, err := c.get(r, indexURL, header)
+	if err != nil {
+		return nil, indexValidators{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, cached, nil
+	case http.StatusOK:
+	default:
+		return nil, indexValidators{}, errors.Errorf("got status code %d trying to download %s", resp.StatusCode, indexURL)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, indexValidators{}, err
+	}
+	return data, indexValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// swapIndex replaces the cached index of a repository after checking that
+// the new one is valid. The file is renamed into place so that readers never
+// see a partial index.
+func (c *Client) swapIndex(r Repository, path string, data []byte, validators indexValidators) error {
+	fd, err := ioutil.TempFile(filepath.Dir(path), "index-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp index file")
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write(data)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write the index of repository %q", r.Name)
+	}
+	if _, err := repo.LoadIndexFile(fd.Name()); err != nil {
+		return errors.Wrapf(err, "invalid index for repository %q", r.Name)
+	}
+	if err := os.Rename(fd.Name(), path); err != nil {
+		return errors.Wrapf(err, "failed to replace the index of repository %q", r.Name)
+	}
+
+	c.mu.Lock()
+	c.validators[r.Name] = validators
+	c.mu.Unlock()
+	LastRefreshTime.WithLabelValues(r.Name).Set(float64(time.Now().Unix()))
+	return nil
+}
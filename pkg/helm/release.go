@@ -0,0 +1,37 @@
+package helm
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// Release backends that can be selected with NewReleaseManager
+const (
+	BackendTiller  = "tiller"
+	BackendSecrets = "secrets"
+)
+
+// ErrReleaseNotFound is returned by a ReleaseManager when the release does not
+// exist.
+var ErrReleaseNotFound = errors.New("release not found")
+
+// ReleaseManager installs charts as releases and keeps track of them.
+type ReleaseManager interface {
+	// InstallRelease installs the chart as a release with the given name. A
+	// name can be reused when its previous release was not deployed.
+	InstallRelease(chart *chart.Chart, name, namespace string, values []byte, wait bool) (*release.Release, error)
+	// UpgradeRelease upgrades an existing release to the given chart and
+	// values.
+	UpgradeRelease(name string, chart *chart.Chart, values []byte, wait bool) (*release.Release, error)
+	// DeleteRelease deletes the resources of a release and forgets about it.
+	DeleteRelease(name string) error
+	// GetRelease returns the latest revision of a release.
+	GetRelease(name string) (*release.Release, error)
+}
+
+var (
+	_ ReleaseManager = &TillerReleaseManager{}
+	_ ReleaseManager = &SecretsReleaseManager{}
+	_ ReleaseManager = &FakeReleaseManager{}
+)
@@ -0,0 +1,161 @@
+package helm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func TestFakeReleaseManager(t *testing.T) {
+	m := NewFakeReleaseManager()
+
+	if _, err := m.GetRelease("db"); errors.Cause(err) != ErrReleaseNotFound {
+		t.Fatalf("expected ErrReleaseNotFound, got %v", err)
+	}
+	if _, err := m.InstallRelease(nil, "db", "ns", []byte("a: 1\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.InstallRelease(nil, "db", "ns", nil, false); err == nil {
+		t.Fatal("expected reinstalling a deployed release to fail")
+	}
+
+	rel, err := m.UpgradeRelease("db", nil, []byte("a: 2\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 2 || rel.Namespace != "ns" || rel.GetConfig().GetRaw() != "a: 2\n" {
+		t.Errorf("unexpected release after upgrade: %+v", rel)
+	}
+	if code := rel.GetInfo().GetStatus().GetCode(); code != release.Status_DEPLOYED {
+		t.Errorf("expected release to be deployed, got %s", code)
+	}
+
+	if err := m.DeleteRelease("db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteRelease("db"); errors.Cause(err) != ErrReleaseNotFound {
+		t.Fatalf("expected ErrReleaseNotFound, got %v", err)
+	}
+}
+
+func TestTillerTLSRequiresCA(t *testing.T) {
+	_, err := NewTillerReleaseManager(TillerOptions{
+		Host:    "tiller:44134",
+		TLSCert: "tls.crt",
+		TLSKey:  "tls.key",
+	})
+	if err == nil {
+		t.Errorf("NewTillerReleaseManager: expected TLS without a CA certificate to be rejected")
+	}
+}
+
+func TestSecretsReleaseManagerTimeout(t *testing.T) {
+	if m := NewSecretsReleaseManager(nil, "minibroker", 10*time.Minute); m.timeout != 10*time.Minute {
+		t.Errorf("expected the configured timeout, actual %s", m.timeout)
+	}
+	if m := NewSecretsReleaseManager(nil, "minibroker", 0); m.timeout != defaultWaitTimeout {
+		t.Errorf("expected the default timeout, actual %s", m.timeout)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	manifest := `---
+# Source: db/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: db
+---
+# Source: db/templates/empty.yaml
+---
+# Source: db/templates/test.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: db-test
+  annotations:
+    helm.sh/hook: test-success
+---
+# Source: db/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: db
+---
+# Source: db/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+`
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"Secret", "Service", "Deployment"}
+	if len(objects) != len(expected) {
+		t.Fatalf("expected %d objects, got %d", len(expected), len(objects))
+	}
+	for i, kind := range expected {
+		if objects[i].GetKind() != kind {
+			t.Errorf("expected object %d to be a %s, got %s", i, kind, objects[i].GetKind())
+		}
+	}
+}
+
+func TestManifestPatch(t *testing.T) {
+	original := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":        "db",
+			"annotations": map[string]interface{}{"removed": "yes", "kept": "yes"},
+		},
+		"data": map[string]interface{}{"a": "1", "b": "2"},
+	}
+	modified := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":        "db",
+			"annotations": map[string]interface{}{"kept": "yes"},
+		},
+		"data": map[string]interface{}{"a": "3"},
+		"type": "Opaque",
+	}
+	expected := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":        "db",
+			"annotations": map[string]interface{}{"removed": nil, "kept": "yes"},
+		},
+		"data": map[string]interface{}{"a": "3", "b": nil},
+		"type": "Opaque",
+	}
+
+	if actual := manifestPatch(original, modified); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("manifestPatch: expected %v, actual %v", expected, actual)
+	}
+	if actual := manifestPatch(nil, modified); !reflect.DeepEqual(actual, modified) {
+		t.Errorf("manifestPatch of a new resource: expected %v, actual %v", modified, actual)
+	}
+}
+
+func TestCollectionPath(t *testing.T) {
+	testcases := []struct {
+		groupVersion string
+		namespace    string
+		resource     string
+		want         string
+	}{
+		{"v1", "ns", "services", "/api/v1/namespaces/ns/services"},
+		{"apps/v1", "ns", "deployments", "/apis/apps/v1/namespaces/ns/deployments"},
+		{"rbac.authorization.k8s.io/v1", "", "clusterroles", "/apis/rbac.authorization.k8s.io/v1/clusterroles"},
+	}
+
+	for _, tc := range testcases {
+		got := collectionPath(tc.groupVersion, tc.namespace, tc.resource)
+		if got != tc.want {
+			t.Errorf("collectionPath(%q, %q, %q) = %q, want %q", tc.groupVersion, tc.namespace, tc.resource, got, tc.want)
+		}
+	}
+}
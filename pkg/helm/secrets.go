@@ -0,0 +1,612 @@
+package helm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/releaseutil"
+	"k8s.io/helm/pkg/renderutil"
+)
+
+const (
+	releaseSecretPrefix = "minibroker.release."
+	releaseDataKey      = "release"
+	hookAnnotation      = "helm.sh/hook"
+
+	waitPollInterval   = 2 * time.Second
+	defaultWaitTimeout = 5 * time.Minute
+)
+
+// installOrder is the order in which Tiller creates the resources of each
+// kind. Resources are deleted in the reverse order.
+var installOrder = []string{
+	"Namespace",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"PodDisruptionBudget",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"ServiceAccount",
+	"CustomResourceDefinition",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"Ingress",
+	"APIService",
+}
+
+// SecretsReleaseManager installs releases without Tiller: charts are rendered
+// by the broker, their resources are applied through the Kubernetes API and
+// the state of every release is kept in a Secret, the same way Helm 3 does.
+type SecretsReleaseManager struct {
+	coreClient kubernetes.Interface
+	// namespace is where the release Secrets are stored
+	namespace string
+	// timeout bounds waiting for the resources of a release to be ready
+	timeout time.Duration
+}
+
+// NewSecretsReleaseManager returns a release manager storing the state of the
+// releases in Secrets of the given namespace. A timeout of 0 waits for the
+// resources of releases for 5 minutes.
+func NewSecretsReleaseManager(coreClient kubernetes.Interface, namespace string, timeout time.Duration) *SecretsReleaseManager {
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout
+	}
+	return &SecretsReleaseManager{
+		coreClient: coreClient,
+		namespace:  namespace,
+		timeout:    timeout,
+	}
+}
+
+func (m *SecretsReleaseManager) InstallRelease(ch *chart.Chart, name, namespace string, values []byte, wait bool) (*release.Release, error) {
+	version := int32(1)
+	previous, err := m.GetRelease(name)
+	if err == nil {
+		if previous.GetInfo().GetStatus().GetCode() == release.Status_DEPLOYED {
+			return nil, errors.Errorf("release %s already exists", name)
+		}
+		version = previous.Version + 1
+	} else if errors.Cause(err) != ErrReleaseNotFound {
+		return nil, err
+	}
+
+	rel := &release.Release{
+		Name:      name,
+		Namespace: namespace,
+		Version:   version,
+		Chart:     ch,
+		Config:    &chart.Config{Raw: string(values)},
+		Info: &release.Info{
+			FirstDeployed: ptypes.TimestampNow(),
+			Status:        &release.Status{Code: release.Status_PENDING_INSTALL},
+		},
+	}
+	glog.Infof("Installing release %s on namespace %s...", name, namespace)
+	// Resources left behind by a failed release are replaced
+	return m.deploy(rel, previous, wait)
+}
+
+func (m *SecretsReleaseManager) UpgradeRelease(name string, ch *chart.Chart, values []byte, wait bool) (*release.Release, error) {
+	previous, err := m.GetRelease(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rel := &release.Release{
+		Name:      name,
+		Namespace: previous.Namespace,
+		Version:   previous.Version + 1,
+		Chart:     ch,
+		Config:    &chart.Config{Raw: string(values)},
+		Info: &release.Info{
+			FirstDeployed: previous.GetInfo().GetFirstDeployed(),
+			Status:        &release.Status{Code: release.Status_PENDING_UPGRADE},
+		},
+	}
+	glog.Infof("Upgrading release %s to revision %d...", name, rel.Version)
+	return m.deploy(rel, previous, wait)
+}
+
+func (m *SecretsReleaseManager) DeleteRelease(name string) error {
+	rel, err := m.GetRelease(name)
+	if err != nil {
+		return err
+	}
+
+	rel.Info.Status.Code = release.Status_DELETING
+	if err := m.storeRelease(rel); err != nil {
+		return err
+	}
+
+	objects, err := parseManifest(rel.Manifest)
+	if err != nil {
+		return err
+	}
+	err = m.deleteObjects(newResourceMapper(m.coreClient.Discovery()), objects, rel.Namespace, nil)
+	if err != nil {
+		return err
+	}
+
+	err = m.coreClient.CoreV1().Secrets(m.namespace).Delete(releaseSecretName(name), &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "could not delete the state of release %s", name)
+	}
+	return nil
+}
+
+func (m *SecretsReleaseManager) GetRelease(name string) (*release.Release, error) {
+	secret, err := m.coreClient.CoreV1().Secrets(m.namespace).Get(releaseSecretName(name), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, errors.Wrapf(ErrReleaseNotFound, "release %s", name)
+		}
+		return nil, errors.Wrapf(err, "could not get release %s", name)
+	}
+	return decodeRelease(secret.Data[releaseDataKey])
+}
+
+// deploy renders the release and applies its resources, deleting those of the
+// previous release that are no longer part of it.
+func (m *SecretsReleaseManager) deploy(rel, previous *release.Release, wait bool) (*release.Release, error) {
+	description := "Install complete"
+	if rel.Info.Status.Code == release.Status_PENDING_UPGRADE {
+		description = "Upgrade complete"
+	}
+
+	manifest, err := m.render(rel)
+	if err != nil {
+		return nil, err
+	}
+	rel.Manifest = manifest
+	rel.Info.LastDeployed = ptypes.TimestampNow()
+	if err := m.storeRelease(rel); err != nil {
+		return nil, err
+	}
+
+	err = m.apply(rel, previous)
+	if err == nil && wait {
+		err = m.waitForResources(rel)
+	}
+	if err != nil {
+		rel.Info.Status.Code = release.Status_FAILED
+		rel.Info.Description = err.Error()
+		if storeErr := m.storeRelease(rel); storeErr != nil {
+			glog.Errorf("Could not record the failure of release %s: %s", rel.Name, storeErr)
+		}
+		return nil, err
+	}
+
+	rel.Info.Status.Code = release.Status_DEPLOYED
+	rel.Info.Description = description
+	if err := m.storeRelease(rel); err != nil {
+		return nil, err
+	}
+	return rel, nil
+}
+
+// render returns the manifest of the release, with the same layout Tiller
+// uses.
+func (m *SecretsReleaseManager) render(rel *release.Release) (string, error) {
+	opts := renderutil.Options{
+		ReleaseOptions: chartutil.ReleaseOptions{
+			Name:      rel.Name,
+			Namespace: rel.Namespace,
+			Revision:  int(rel.Version),
+			IsInstall: rel.Info.Status.Code == release.Status_PENDING_INSTALL,
+			IsUpgrade: rel.Info.Status.Code == release.Status_PENDING_UPGRADE,
+		},
+	}
+	if info, err := m.coreClient.Discovery().ServerVersion(); err == nil {
+		opts.KubeVersion = info.GitVersion
+	} else {
+		glog.Errorf("Could not get the server version, rendering with the default: %s", err)
+	}
+
+	files, err := renderutil.Render(rel.Chart, rel.Config, opts)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not render release %s", rel.Name)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var manifest bytes.Buffer
+	for _, name := range names {
+		content := files[name]
+		if path.Base(name) == "NOTES.txt" || strings.TrimSpace(content) == "" {
+			continue
+		}
+		fmt.Fprintf(&manifest, "---\n# Source: %s\n%s\n", name, content)
+	}
+	return manifest.String(), nil
+}
+
+// apply creates or patches the resources of the release. Resources are
+// patched against the manifest of the previous release, so that the fields
+// removed from the chart are removed from the resources too.
+func (m *SecretsReleaseManager) apply(rel, previous *release.Release) error {
+	objects, err := parseManifest(rel.Manifest)
+	if err != nil {
+		return err
+	}
+
+	mapper := newResourceMapper(m.coreClient.Discovery())
+	var stale []*unstructured.Unstructured
+	originals := map[string]*unstructured.Unstructured{}
+	if previous != nil {
+		stale, err = parseManifest(previous.Manifest)
+		if err != nil {
+			return err
+		}
+		for _, obj := range stale {
+			collection, err := mapper.collectionPath(obj, previous.Namespace)
+			if err != nil {
+				return err
+			}
+			originals[path.Join(collection, obj.GetName())] = obj
+		}
+	}
+
+	client := m.coreClient.Discovery().RESTClient()
+	applied := map[string]bool{}
+	for _, obj := range objects {
+		collection, err := mapper.collectionPath(obj, rel.Namespace)
+		if err != nil {
+			return err
+		}
+		itemPath := path.Join(collection, obj.GetName())
+		var original map[string]interface{}
+		if prior, ok := originals[itemPath]; ok {
+			original = prior.Object
+		}
+		patch, err := json.Marshal(manifestPatch(original, obj.Object))
+		if err != nil {
+			return errors.Wrapf(err, "could not marshall %s %s", obj.GetKind(), obj.GetName())
+		}
+
+		glog.Infof("Applying %s %s", obj.GetKind(), itemPath)
+		err = client.Patch(types.MergePatchType).AbsPath(itemPath).Body(patch).Do().Error()
+		if apierrors.IsNotFound(err) {
+			var data []byte
+			data, err = obj.MarshalJSON()
+			if err != nil {
+				return errors.Wrapf(err, "could not marshall %s %s", obj.GetKind(), obj.GetName())
+			}
+			err = client.Post().AbsPath(collection).Body(data).Do().Error()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not apply %s %s", obj.GetKind(), itemPath)
+		}
+		applied[itemPath] = true
+	}
+
+	if previous == nil {
+		return nil
+	}
+	return m.deleteObjects(mapper, stale, previous.Namespace, applied)
+}
+
+// manifestPatch returns the merge patch setting the fields of a resource in
+// the modified manifest, and removing the ones only found in the original
+// manifest. The fields set by anything else than the manifests are kept.
+func manifestPatch(original, modified map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{}, len(modified))
+	for key, value := range modified {
+		originalValue, _ := original[key].(map[string]interface{})
+		if modifiedValue, ok := value.(map[string]interface{}); ok && originalValue != nil {
+			patch[key] = manifestPatch(originalValue, modifiedValue)
+			continue
+		}
+		patch[key] = value
+	}
+	for key := range original {
+		if _, ok := modified[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	return patch
+}
+
+// deleteObjects deletes the given resources in reverse install order, except
+// for the paths in keep.
+func (m *SecretsReleaseManager) deleteObjects(mapper *resourceMapper, objects []*unstructured.Unstructured, namespace string, keep map[string]bool) error {
+	client := m.coreClient.Discovery().RESTClient()
+	propagation := metav1.DeletePropagationBackground
+	options, err := json.Marshal(metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil {
+		return err
+	}
+
+	for i := len(objects) - 1; i >= 0; i-- {
+		obj := objects[i]
+		collection, err := mapper.collectionPath(obj, namespace)
+		if err != nil {
+			return err
+		}
+		itemPath := path.Join(collection, obj.GetName())
+		if keep[itemPath] {
+			continue
+		}
+
+		glog.Infof("Deleting %s %s", obj.GetKind(), itemPath)
+		err = client.Delete().AbsPath(itemPath).Body(options).Do().Error()
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "could not delete %s %s", obj.GetKind(), itemPath)
+		}
+	}
+	return nil
+}
+
+// waitForResources waits until the workloads of the release are ready.
+func (m *SecretsReleaseManager) waitForResources(rel *release.Release) error {
+	objects, err := parseManifest(rel.Manifest)
+	if err != nil {
+		return err
+	}
+
+	mapper := newResourceMapper(m.coreClient.Discovery())
+	client := m.coreClient.Discovery().RESTClient()
+	err = wait.PollImmediate(waitPollInterval, m.timeout, func() (bool, error) {
+		for _, obj := range objects {
+			collection, err := mapper.collectionPath(obj, rel.Namespace)
+			if err != nil {
+				return false, err
+			}
+			raw, err := client.Get().AbsPath(path.Join(collection, obj.GetName())).Do().Raw()
+			if err != nil {
+				return false, err
+			}
+			current := &unstructured.Unstructured{}
+			if err := current.UnmarshalJSON(raw); err != nil {
+				return false, err
+			}
+			if !isReady(current) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "release %s did not become ready", rel.Name)
+	}
+	return nil
+}
+
+// isReady reports whether a workload has all of its replicas ready. Resources
+// of other kinds are ready as soon as they exist.
+func isReady(obj *unstructured.Unstructured) bool {
+	content := obj.UnstructuredContent()
+	switch obj.GetKind() {
+	case "Deployment", "StatefulSet":
+		observed, _, _ := unstructured.NestedInt64(content, "status", "observedGeneration")
+		if observed < obj.GetGeneration() {
+			return false
+		}
+		replicas, found, _ := unstructured.NestedInt64(content, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+		ready, _, _ := unstructured.NestedInt64(content, "status", "readyReplicas")
+		return ready >= replicas
+	case "DaemonSet":
+		observed, _, _ := unstructured.NestedInt64(content, "status", "observedGeneration")
+		if observed < obj.GetGeneration() {
+			return false
+		}
+		desired, _, _ := unstructured.NestedInt64(content, "status", "desiredNumberScheduled")
+		ready, _, _ := unstructured.NestedInt64(content, "status", "numberReady")
+		return ready >= desired
+	}
+	return true
+}
+
+func (m *SecretsReleaseManager) storeRelease(rel *release.Release) error {
+	data, err := encodeRelease(rel)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      releaseSecretName(rel.Name),
+			Namespace: m.namespace,
+			Labels: map[string]string{
+				"owner":   "minibroker",
+				"name":    rel.Name,
+				"status":  rel.GetInfo().GetStatus().GetCode().String(),
+				"version": strconv.Itoa(int(rel.Version)),
+			},
+		},
+		Data: map[string][]byte{
+			releaseDataKey: data,
+		},
+	}
+	secrets := m.coreClient.CoreV1().Secrets(m.namespace)
+	_, err = secrets.Update(secret)
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(secret)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not store the state of release %s", rel.Name)
+	}
+	return nil
+}
+
+func releaseSecretName(name string) string {
+	return releaseSecretPrefix + name
+}
+
+// encodeRelease serializes a release as gzipped JSON, as charts easily
+// outgrow the size limit of a Secret otherwise.
+func encodeRelease(rel *release.Release) ([]byte, error) {
+	data, err := json.Marshal(rel)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not marshall release %s", rel.Name)
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, errors.Wrapf(err, "could not compress release %s", rel.Name)
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrapf(err, "could not compress release %s", rel.Name)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRelease(data []byte) (*release.Release, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decompress release")
+	}
+	defer r.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decompress release")
+	}
+
+	rel := &release.Release{}
+	if err := json.Unmarshal(raw, rel); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshall release")
+	}
+	return rel, nil
+}
+
+// parseManifest splits a release manifest into its resources, sorted in
+// install order. Hooks are left out since the broker never runs them.
+func parseManifest(manifest string) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	for name, doc := range releaseutil.SplitManifests(manifest) {
+		data, err := yaml.YAMLToJSON([]byte(doc))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s", name)
+		}
+		if string(data) == "null" {
+			// Only comments
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(data); err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s", name)
+		}
+		if _, ok := obj.GetAnnotations()[hookAnnotation]; ok {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		oi, oj := installIndex(objects[i].GetKind()), installIndex(objects[j].GetKind())
+		if oi != oj {
+			return oi < oj
+		}
+		return objects[i].GetName() < objects[j].GetName()
+	})
+	return objects, nil
+}
+
+func installIndex(kind string) int {
+	for i, k := range installOrder {
+		if k == kind {
+			return i
+		}
+	}
+	return len(installOrder)
+}
+
+// resourceMapper finds the API paths of resources using discovery.
+type resourceMapper struct {
+	discovery discovery.DiscoveryInterface
+	resources map[string]*metav1.APIResourceList
+}
+
+func newResourceMapper(d discovery.DiscoveryInterface) *resourceMapper {
+	return &resourceMapper{
+		discovery: d,
+		resources: map[string]*metav1.APIResourceList{},
+	}
+}
+
+// collectionPath returns the path of the collection holding obj. Namespaced
+// resources without a namespace are placed in the given one.
+func (r *resourceMapper) collectionPath(obj *unstructured.Unstructured, namespace string) (string, error) {
+	groupVersion := obj.GetAPIVersion()
+	list, ok := r.resources[groupVersion]
+	if !ok {
+		var err error
+		list, err = r.discovery.ServerResourcesForGroupVersion(groupVersion)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not discover the resources of %s", groupVersion)
+		}
+		r.resources[groupVersion] = list
+	}
+
+	for _, resource := range list.APIResources {
+		if resource.Kind != obj.GetKind() || strings.Contains(resource.Name, "/") {
+			continue
+		}
+		if !resource.Namespaced {
+			return collectionPath(groupVersion, "", resource.Name), nil
+		}
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+		return collectionPath(groupVersion, obj.GetNamespace(), resource.Name), nil
+	}
+	return "", errors.Errorf("%s is not served by %s", obj.GetKind(), groupVersion)
+}
+
+func collectionPath(groupVersion, namespace, resource string) string {
+	segments := []string{"/apis", groupVersion}
+	if !strings.Contains(groupVersion, "/") {
+		segments[0] = "/api"
+	}
+	if namespace != "" {
+		segments = append(segments, "namespaces", namespace)
+	}
+	return path.Join(append(segments, resource)...)
+}
@@ -0,0 +1,182 @@
+package helm
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/tlsutil"
+)
+
+const (
+	defaultTillerHost           = "localhost:44134"
+	defaultTillerConnectTimeout = 5 * time.Second
+	defaultTillerTimeout        = 5 * time.Minute
+)
+
+// TillerOptions configures the connection to Tiller.
+type TillerOptions struct {
+	// Host is the address of Tiller, as host:port
+	Host string
+	// TLSCert and TLSKey are the paths of the client certificate and key
+	// presented to Tiller. TLS is enabled when they or TLSCACert are set.
+	TLSCert string
+	TLSKey  string
+	// TLSCACert is the path of the CA certificate used to verify Tiller, which
+	// is required when TLS is enabled
+	TLSCACert string
+	// ConnectTimeout bounds connecting to Tiller
+	ConnectTimeout time.Duration
+	// Timeout bounds the operations Tiller runs, e.g. waiting for a release
+	Timeout time.Duration
+}
+
+// TillerReleaseManager manages releases through a Tiller server.
+type TillerReleaseManager struct {
+	host           string
+	tlsConfig      *tls.Config
+	connectTimeout int64
+	timeout        int64
+}
+
+func NewTillerReleaseManager(opts TillerOptions) (*TillerReleaseManager, error) {
+	m := &TillerReleaseManager{
+		host:           opts.Host,
+		connectTimeout: seconds(opts.ConnectTimeout, defaultTillerConnectTimeout),
+		timeout:        seconds(opts.Timeout, defaultTillerTimeout),
+	}
+	if m.host == "" {
+		m.host = defaultTillerHost
+	}
+
+	if opts.TLSCert != "" || opts.TLSKey != "" || opts.TLSCACert != "" {
+		if opts.TLSCACert == "" {
+			return nil, errors.New("a CA certificate is required to verify tiller when TLS is enabled")
+		}
+		serverName, _, err := net.SplitHostPort(m.host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tiller host %q", m.host)
+		}
+		m.tlsConfig, err = tlsutil.ClientConfig(tlsutil.Options{
+			CertFile:   opts.TLSCert,
+			KeyFile:    opts.TLSKey,
+			CaCertFile: opts.TLSCACert,
+			ServerName: serverName,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load the tiller TLS configuration")
+		}
+	}
+
+	return m, nil
+}
+
+// seconds converts a timeout to the whole seconds helm expects.
+func seconds(timeout, defaultTimeout time.Duration) int64 {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return int64(timeout.Round(time.Second) / time.Second)
+}
+
+func (m *TillerReleaseManager) connect() (*helm.Client, error) {
+	glog.Infof("Connecting to tiller at %s...", m.host)
+
+	opts := []helm.Option{
+		helm.Host(m.host),
+		helm.ConnectTimeout(m.connectTimeout),
+	}
+	if m.tlsConfig != nil {
+		opts = append(opts, helm.WithTLS(m.tlsConfig))
+	}
+	tc := helm.NewClient(opts...)
+
+	err := tc.PingTiller()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to tiller at %s", m.host)
+	}
+
+	glog.Infoln("Connected!")
+
+	return tc, nil
+}
+
+func (m *TillerReleaseManager) InstallRelease(ch *chart.Chart, name, namespace string, values []byte, wait bool) (*release.Release, error) {
+	tc, err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := tc.InstallReleaseFromChart(ch, namespace,
+		helm.ReleaseName(name),
+		helm.ValueOverrides(values),
+		helm.InstallReuseName(true),
+		helm.InstallDisableHooks(true),
+		helm.InstallWait(wait),
+		helm.InstallTimeout(m.timeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetRelease(), nil
+}
+
+func (m *TillerReleaseManager) UpgradeRelease(name string, ch *chart.Chart, values []byte, wait bool) (*release.Release, error) {
+	tc, err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := tc.UpdateReleaseFromChart(name, ch,
+		helm.UpdateValueOverrides(values),
+		helm.UpgradeDisableHooks(true),
+		helm.UpgradeWait(wait),
+		helm.UpgradeTimeout(m.timeout),
+	)
+	if err != nil {
+		return nil, tillerError(err)
+	}
+	return resp.GetRelease(), nil
+}
+
+func (m *TillerReleaseManager) DeleteRelease(name string) error {
+	tc, err := m.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = tc.DeleteRelease(name,
+		helm.DeleteDisableHooks(false),
+		helm.DeletePurge(true),
+		helm.DeleteTimeout(m.timeout),
+	)
+	return tillerError(err)
+}
+
+func (m *TillerReleaseManager) GetRelease(name string) (*release.Release, error) {
+	tc, err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := tc.ReleaseContent(name, helm.ContentReleaseVersion(0))
+	if err != nil {
+		return nil, tillerError(err)
+	}
+	return resp.GetRelease(), nil
+}
+
+// tillerError translates the errors Tiller reports for missing releases, which
+// only carry a message over gRPC, to ErrReleaseNotFound.
+func tillerError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		return errors.Wrap(ErrReleaseNotFound, err.Error())
+	}
+	return err
+}
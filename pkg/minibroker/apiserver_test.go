@@ -0,0 +1,235 @@
+package minibroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeAPIServer keeps the core objects minibroker uses in memory and serves
+// them over the Kubernetes API, as no fake clientset is vendored.
+type fakeAPIServer struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// objects are keyed by resource, namespace and name
+	objects map[string]metav1.Object
+	created int
+	// forbidden are the resources requests are denied access to
+	forbidden map[string]bool
+}
+
+var fakeAPIKinds = map[string]string{
+	"namespaces": "Namespace",
+	"configmaps": "ConfigMap",
+	"secrets":    "Secret",
+	"services":   "Service",
+	"pods":       "Pod",
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, kubernetes.Interface) {
+	s := &fakeAPIServer{objects: map[string]metav1.Object{}, forbidden: map[string]bool{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: s.server.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, client
+}
+
+func (s *fakeAPIServer) close() {
+	s.server.Close()
+}
+
+func newFakeAPIObject(resource string) metav1.Object {
+	switch resource {
+	case "namespaces":
+		return &corev1.Namespace{}
+	case "configmaps":
+		return &corev1.ConfigMap{}
+	case "secrets":
+		return &corev1.Secret{}
+	case "services":
+		return &corev1.Service{}
+	case "pods":
+		return &corev1.Pod{}
+	}
+	return nil
+}
+
+func fakeAPIKey(resource, namespace, name string) string {
+	return strings.Join([]string{resource, namespace, name}, "/")
+}
+
+// add stores an object the way the API server would create it.
+func (s *fakeAPIServer) add(resource string, object metav1.Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(resource, object)
+}
+
+// forbid denies access to a resource.
+func (s *fakeAPIServer) forbid(resource string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forbidden[resource] = true
+}
+
+// get returns a stored object, or nil if there is none.
+func (s *fakeAPIServer) get(resource, namespace, name string) metav1.Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[fakeAPIKey(resource, namespace, name)]
+}
+
+func (s *fakeAPIServer) store(resource string, object metav1.Object) {
+	if object.GetName() == "" {
+		s.created++
+		object.SetName(fmt.Sprintf("%s%d", object.GetGenerateName(), s.created))
+	}
+	if secret, ok := object.(*corev1.Secret); ok {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		for key, value := range secret.StringData {
+			secret.Data[key] = []byte(value)
+		}
+		secret.StringData = nil
+	}
+	s.objects[fakeAPIKey(resource, object.GetNamespace(), object.GetName())] = object
+}
+
+func (s *fakeAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// /api/v1/namespaces/{namespace}/{resource}[/{name}], or
+	// /api/v1/namespaces[/{name}]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "api" || parts[1] != "v1" || parts[2] != "namespaces" {
+		s.writeStatus(w, apierrors.NewBadRequest(fmt.Sprintf("unsupported path %s", r.URL.Path)).ErrStatus)
+		return
+	}
+	if len(parts) <= 4 {
+		// Namespaces are named by their own name
+		parts = append([]string{"api", "v1", "namespaces", "", "namespaces"}, parts[3:]...)
+	}
+	namespace, resource := parts[3], parts[4]
+	if fakeAPIKinds[resource] == "" {
+		s.writeStatus(w, apierrors.NewBadRequest(fmt.Sprintf("unsupported path %s", r.URL.Path)).ErrStatus)
+		return
+	}
+	gr := schema.GroupResource{Resource: resource}
+	if s.forbidden[resource] {
+		s.writeStatus(w, apierrors.NewForbidden(gr, "", fmt.Errorf("access to %s denied", resource)).ErrStatus)
+		return
+	}
+
+	if len(parts) == 5 {
+		switch r.Method {
+		case http.MethodGet:
+			s.list(w, r, resource, namespace)
+		case http.MethodPost:
+			object := newFakeAPIObject(resource)
+			if err := json.NewDecoder(r.Body).Decode(object); err != nil {
+				s.writeStatus(w, apierrors.NewBadRequest(err.Error()).ErrStatus)
+				return
+			}
+			object.SetNamespace(namespace)
+			if object.GetName() != "" && s.objects[fakeAPIKey(resource, namespace, object.GetName())] != nil {
+				s.writeStatus(w, apierrors.NewAlreadyExists(gr, object.GetName()).ErrStatus)
+				return
+			}
+			s.store(resource, object)
+			s.writeObject(w, http.StatusCreated, resource, object)
+		default:
+			s.writeStatus(w, apierrors.NewMethodNotSupported(gr, r.Method).ErrStatus)
+		}
+		return
+	}
+
+	name := parts[5]
+	key := fakeAPIKey(resource, namespace, name)
+	existing, ok := s.objects[key]
+	if !ok {
+		s.writeStatus(w, apierrors.NewNotFound(gr, name).ErrStatus)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.writeObject(w, http.StatusOK, resource, existing)
+	case http.MethodPut:
+		object := newFakeAPIObject(resource)
+		if err := json.NewDecoder(r.Body).Decode(object); err != nil {
+			s.writeStatus(w, apierrors.NewBadRequest(err.Error()).ErrStatus)
+			return
+		}
+		s.store(resource, object)
+		s.writeObject(w, http.StatusOK, resource, object)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		s.writeStatus(w, metav1.Status{Status: metav1.StatusSuccess, Code: http.StatusOK})
+	default:
+		s.writeStatus(w, apierrors.NewMethodNotSupported(gr, r.Method).ErrStatus)
+	}
+}
+
+func (s *fakeAPIServer) list(w http.ResponseWriter, r *http.Request, resource, namespace string) {
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		s.writeStatus(w, apierrors.NewBadRequest(err.Error()).ErrStatus)
+		return
+	}
+	items := []metav1.Object{}
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, fakeAPIKey(resource, namespace, "")) && selector.Matches(labels.Set(object.GetLabels())) {
+			items = append(items, object)
+		}
+	}
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":       fakeAPIKinds[resource] + "List",
+		"apiVersion": "v1",
+		"metadata":   map[string]interface{}{},
+		"items":      items,
+	})
+}
+
+func (s *fakeAPIServer) writeObject(w http.ResponseWriter, code int, resource string, object metav1.Object) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		s.writeStatus(w, apierrors.NewInternalError(err).ErrStatus)
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		s.writeStatus(w, apierrors.NewInternalError(err).ErrStatus)
+		return
+	}
+	fields["kind"] = fakeAPIKinds[resource]
+	fields["apiVersion"] = "v1"
+	s.writeJSON(w, code, fields)
+}
+
+func (s *fakeAPIServer) writeStatus(w http.ResponseWriter, status metav1.Status) {
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	s.writeJSON(w, int(status.Code), status)
+}
+
+func (s *fakeAPIServer) writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
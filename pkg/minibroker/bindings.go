@@ -0,0 +1,161 @@
+package minibroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Secret keys for tracking the state of a binding
+const (
+	BindingParamsKey      = "bind-params"
+	BindingCredentialsKey = "credentials"
+	BindingUsernameKey    = "username"
+	BindingPasswordKey    = "password"
+)
+
+// getBindingSecret returns the secret persisting the given binding, or nil if
+// the binding does not exist.
+func (c *Client) getBindingSecret(bindingID string) (*corev1.Secret, error) {
+	secret, err := c.coreClient.CoreV1().Secrets(c.namespace).Get(bindingID, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to get binding %q", bindingID)
+	}
+	return secret, nil
+}
+
+// createBindingSecret persists a new binding of the given instance.
+func (c *Client) createBindingSecret(instanceID, bindingID string, data map[string]string) (*corev1.Secret, error) {
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      bindingID,
+			Namespace: c.namespace,
+			Labels: map[string]string{
+				InstanceLabel: instanceID,
+			},
+		},
+		StringData: data,
+	}
+	created, err := c.coreClient.CoreV1().Secrets(c.namespace).Create(&secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not persist binding %q", bindingID)
+	}
+	return created, nil
+}
+
+// updateBindingSecret will update the secret data for the given binding, with
+// the same semantics as updateConfigMap.
+func (c *Client) updateBindingSecret(secret *corev1.Secret, data map[string]interface{}) (*corev1.Secret, error) {
+	secret = secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for name, value := range data {
+		if value == nil {
+			delete(secret.Data, name)
+		} else if stringValue, ok := value.(string); ok {
+			secret.Data[name] = []byte(stringValue)
+		} else {
+			panic(fmt.Sprintf("Invalid data (key %s), has value %+v", name, value))
+		}
+	}
+
+	updated, err := c.coreClient.CoreV1().Secrets(c.namespace).Update(secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to update binding %q", secret.Name)
+	}
+	return updated, nil
+}
+
+func (c *Client) deleteBindingSecret(bindingID string) error {
+	err := c.coreClient.CoreV1().Secrets(c.namespace).Delete(bindingID, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "could not delete binding %q", bindingID)
+	}
+	return nil
+}
+
+// deleteBindings deletes the bindings of an instance the platform did not
+// unbind before deprovisioning it, along with their users.
+func (c *Client) deleteBindings(instanceID, serviceID string) error {
+	secrets, err := c.coreClient.CoreV1().Secrets(c.namespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			InstanceLabel: instanceID,
+		}).String(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not list the bindings of instance %q", instanceID)
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if _, ok := secret.Data[BindingParamsKey]; !ok {
+			// A chart secret of a release installed into the broker namespace
+			continue
+		}
+		glog.Infof("Deleting binding %q of instance %q", secret.Name, instanceID)
+		if err := c.unbindSynchronously(instanceID, serviceID, secret); err != nil {
+			// The users go away with the release anyway, which may be too
+			// broken for them to be dropped
+			glog.Warningf("Could not unbind %q, deleting it with the release: %s", secret.Name, err)
+			if err := c.deleteBindingSecret(secret.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bindingCredentials returns the stored credentials of a binding, or nil if
+// the binding has not completed.
+func bindingCredentials(secret *corev1.Secret) (map[string]interface{}, error) {
+	raw, ok := secret.Data[BindingCredentialsKey]
+	if !ok {
+		return nil, nil
+	}
+	var creds map[string]interface{}
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshall credentials of binding %q", secret.Name)
+	}
+	return creds, nil
+}
+
+// marshalBindParams serializes binding parameters so that identical requests
+// always produce the same string.
+func marshalBindParams(params map[string]interface{}) (string, error) {
+	if len(params) == 0 {
+		return "{}", nil
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not marshall binding parameters %v", params)
+	}
+	return string(paramsJSON), nil
+}
+
+// sameBinding reports whether an existing binding was created with the same
+// attributes.
+func sameBinding(secret *corev1.Secret, instanceID, serviceID, planID, paramsJSON string) bool {
+	return secret.Labels[InstanceLabel] == instanceID &&
+		string(secret.Data[ServiceKey]) == serviceID &&
+		string(secret.Data[PlanKey]) == planID &&
+		string(secret.Data[BindingParamsKey]) == paramsJSON
+}
+
+func bindingConflictError(bindingID string) error {
+	msg := fmt.Sprintf("binding %q already exists with different attributes", bindingID)
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusConflict,
+		Description: &msg,
+	}
+}
@@ -0,0 +1,214 @@
+package minibroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"k8s.io/helm/pkg/repo"
+)
+
+// Catalog customizes the services and plans generated from the charts. It is
+// read from the file given with --catalogPath.
+type Catalog struct {
+	// Services are keyed by the generated service ID
+	Services map[string]CatalogService `json:"services"`
+	// Parameters is the policy applied to the parameters of every service
+	Parameters ParameterPolicy `json:"parameters,omitempty"`
+}
+
+// CatalogService overrides the generated fields of a service. Services listed
+// in the catalog are offered even when minibroker has no provider for them.
+type CatalogService struct {
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	// Versions are patterns, as in path.Match, of the app versions offered as
+	// plans. All app versions are offered when empty.
+	Versions []string `json:"versions,omitempty"`
+	// Plans are keyed by app version
+	Plans map[string]CatalogPlan `json:"plans,omitempty"`
+	// Tiers are additional plans installing an app version with preset
+	// values, e.g. to offer small and large databases
+	Tiers []CatalogTier `json:"tiers,omitempty"`
+	// TiersOnly hides the plans generated for every app version
+	TiersOnly bool `json:"tiersOnly,omitempty"`
+	// Parameters is the policy applied to the parameters of the service, on
+	// top of the one of the catalog
+	Parameters ParameterPolicy `json:"parameters,omitempty"`
+}
+
+// CatalogPlan overrides the generated fields of a plan.
+type CatalogPlan struct {
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// CatalogTier is a plan defined by the operator.
+type CatalogTier struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// Version is the app version installed by the plan
+	Version string `json:"version"`
+	// Values are applied underneath the parameters of the instance
+	Values map[string]interface{} `json:"values,omitempty"`
+}
+
+// LoadCatalog reads a catalog file. An empty path gives an empty catalog.
+func LoadCatalog(catalogPath string) (*Catalog, error) {
+	catalog := &Catalog{}
+	if catalogPath == "" {
+		return catalog, nil
+	}
+
+	data, err := ioutil.ReadFile(catalogPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read catalog %s", catalogPath)
+	}
+	if err := unmarshalStrict(data, catalog); err != nil {
+		return nil, errors.Wrapf(err, "could not parse catalog %s", catalogPath)
+	}
+
+	if err := catalog.Parameters.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid parameter policy")
+	}
+	for id, service := range catalog.Services {
+		if err := service.Parameters.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid parameter policy for service %q", id)
+		}
+		for _, pattern := range service.Versions {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid version pattern %q for service %q", pattern, id)
+			}
+		}
+		planIDs := map[string]string{}
+		for _, tier := range service.Tiers {
+			if tier.Name == "" || tier.Version == "" {
+				return nil, errors.Errorf("tiers of service %q need a name and a version", id)
+			}
+			planID := tierPlanID(id, tier.Name)
+			if other, ok := planIDs[planID]; ok {
+				if other == tier.Name {
+					return nil, errors.Errorf("tier %q of service %q is defined more than once", tier.Name, id)
+				}
+				return nil, errors.Errorf("tiers %q and %q of service %q have the same plan ID %s", other, tier.Name, id, planID)
+			}
+			planIDs[planID] = tier.Name
+		}
+	}
+	return catalog, nil
+}
+
+// unmarshalStrict parses YAML into out, rejecting unknown fields so that
+// typos do not go unnoticed.
+func unmarshalStrict(data []byte, out interface{}) error {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// offers reports whether plans are generated for the given app version.
+func (s CatalogService) offers(appVersion string) bool {
+	if s.TiersOnly {
+		return false
+	}
+	if len(s.Versions) == 0 {
+		return true
+	}
+	for _, pattern := range s.Versions {
+		if ok, _ := path.Match(pattern, appVersion); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s CatalogService) apply(svc *osb.Service) {
+	if s.Name != "" {
+		svc.Name = s.Name
+	}
+	if s.Description != "" {
+		svc.Description = s.Description
+	}
+	if s.Metadata != nil {
+		svc.Metadata = s.Metadata
+	}
+	if s.Tags != nil {
+		svc.Tags = s.Tags
+	}
+}
+
+func (s CatalogService) applyPlan(appVersion string, plan *osb.Plan) {
+	override, ok := s.Plans[appVersion]
+	if !ok {
+		return
+	}
+	if override.Name != "" {
+		plan.Name = override.Name
+	}
+	if override.Description != "" {
+		plan.Description = override.Description
+	}
+	if override.Metadata != nil {
+		plan.Metadata = override.Metadata
+	}
+}
+
+// tierPlanID returns the ID of the plan of a tier.
+func tierPlanID(serviceID, name string) string {
+	return planCleaner.ReplaceAllString(strings.ToLower(serviceID+"-"+name), "-")
+}
+
+// tierPlans returns the plans of the tiers whose app version is available,
+// adding what they install to index. Tiers whose plan ID is already used by the
+// plan of an app version are skipped.
+func (s CatalogService) tierPlans(serviceID string, appVersions map[string]*repo.ChartVersion, schemas func(chartVersion string) *osb.ParameterSchemas, index map[string]planChart) []osb.Plan {
+	var plans []osb.Plan
+	for _, tier := range s.Tiers {
+		chartVersion, ok := appVersions[tier.Version]
+		if !ok {
+			glog.Errorf("Skipping tier %q of service %q: app version %s not found", tier.Name, serviceID, tier.Version)
+			continue
+		}
+		planID := tierPlanID(serviceID, tier.Name)
+		if existing, ok := index[planKey(serviceID, planID)]; ok {
+			glog.Errorf("Skipping tier %q of service %q: its plan ID %s is already used by app version %s", tier.Name, serviceID, planID, existing.appVersion)
+			continue
+		}
+		index[planKey(serviceID, planID)] = planChart{
+			chart:        serviceID,
+			chartVersion: chartVersion.Version,
+			appVersion:   tier.Version,
+			values:       tier.Values,
+		}
+
+		description := tier.Description
+		if description == "" {
+			description = fmt.Sprintf("%s %s", tier.Name, tier.Version)
+		}
+		plans = append(plans, osb.Plan{
+			ID:          planID,
+			Name:        tier.Name,
+			Description: description,
+			Metadata:    tier.Metadata,
+			Free:        boolPtr(true),
+
+			ParameterSchemas: schemas(chartVersion.Version),
+		})
+	}
+	return plans
+}
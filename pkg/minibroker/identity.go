@@ -0,0 +1,87 @@
+package minibroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// Platforms of the originating identities minibroker understands.
+const (
+	PlatformKubernetes   = "kubernetes"
+	PlatformCloudFoundry = "cloudfoundry"
+)
+
+// OriginatingIdentity is the user of a platform on whose behalf a request is
+// made, as sent in the X-Broker-API-Originating-Identity header.
+type OriginatingIdentity struct {
+	Platform string `json:"platform"`
+	// User is the Kubernetes username, or the GUID of the CF user
+	User string `json:"user,omitempty"`
+	// UID and Groups are only sent by Kubernetes
+	UID    string   `json:"uid,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// ParseOriginatingIdentity decodes the originating identity of a request. It
+// returns nil when the platform did not send one, and only keeps the platform
+// of the identities of unknown platforms.
+func ParseOriginatingIdentity(identity *osb.OriginatingIdentity) (*OriginatingIdentity, error) {
+	if identity == nil {
+		return nil, nil
+	}
+
+	parsed := &OriginatingIdentity{Platform: identity.Platform}
+	switch identity.Platform {
+	case PlatformKubernetes:
+		var user struct {
+			Username string   `json:"username"`
+			UID      string   `json:"uid"`
+			Groups   []string `json:"groups"`
+		}
+		if err := json.Unmarshal([]byte(identity.Value), &user); err != nil {
+			return nil, invalidIdentity(err.Error())
+		}
+		if user.Username == "" {
+			return nil, invalidIdentity("no username")
+		}
+		parsed.User = user.Username
+		parsed.UID = user.UID
+		parsed.Groups = user.Groups
+	case PlatformCloudFoundry:
+		var user struct {
+			UserID string `json:"user_id"`
+		}
+		if err := json.Unmarshal([]byte(identity.Value), &user); err != nil {
+			return nil, invalidIdentity(err.Error())
+		}
+		if user.UserID == "" {
+			return nil, invalidIdentity("no user_id")
+		}
+		parsed.User = user.UserID
+	default:
+		glog.Warningf("Ignoring the originating identity of unknown platform %q", identity.Platform)
+	}
+	return parsed, nil
+}
+
+func (i *OriginatingIdentity) String() string {
+	if i == nil {
+		return "an unknown user"
+	}
+	if i.User == "" {
+		return fmt.Sprintf("an unknown %s user", i.Platform)
+	}
+	return fmt.Sprintf("%s user %s", i.Platform, i.User)
+}
+
+func invalidIdentity(reason string) error {
+	msg := fmt.Sprintf("invalid originating identity: %s", reason)
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &msg,
+	}
+}
@@ -7,6 +7,18 @@ import (
 
 type MariadbProvider struct{}
 
+func (p MariadbProvider) Parameters() map[string]interface{} {
+	return map[string]interface{}{
+		"db": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": stringParameter("Name of the database to create"),
+				"user": stringParameter("Name of the user to create; root is used when unset"),
+			},
+		},
+	}
+}
+
 func (p MariadbProvider) Bind(services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}) (*Credentials, error) {
 	service := services[0]
 	if len(service.Spec.Ports) == 0 {
@@ -59,3 +71,19 @@ func (p MariadbProvider) Bind(services []corev1.Service, params map[string]inter
 
 	return &creds, nil
 }
+
+func (p MariadbProvider) CreateUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user, password string) (*Credentials, error) {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return nil, err
+	}
+	return createMySQLUser(runner, *creds, "mariadb-root-password", user, password)
+}
+
+func (p MariadbProvider) DropUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user string) error {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return err
+	}
+	return dropMySQLUser(runner, *creds, "mariadb-root-password", user)
+}
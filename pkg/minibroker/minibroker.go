@@ -1,13 +1,17 @@
 package minibroker
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/Masterminds/semver"
 	"github.com/davecgh/go-spew/spew"
@@ -24,8 +28,9 @@ import (
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/helm/pkg/helm"
-	rls "k8s.io/helm/pkg/proto/hapi/services"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
 	"k8s.io/helm/pkg/repo"
 )
 
@@ -35,12 +40,19 @@ const (
 	PlanKey             = "plan-id"
 	ProvisionParamsKey  = "provision-params"
 	ReleaseNamespaceKey = "release-namespace"
+	UpdatePlanKey       = "update-plan-id"
+	UpdateParamsKey     = "update-params"
+	ChartVersionKey     = "chart-version"
 	HeritageLabel       = "heritage"
 	ReleaseLabel        = "release"
 	TillerHeritage      = "Tiller"
 )
 
-// ConfigMap keys for tracking the last operation
+// OriginatingIdentityKey keeps who provisioned an instance in its ConfigMap,
+// as JSON.
+const OriginatingIdentityKey = "originating-identity"
+
+// ConfigMap and binding Secret keys for tracking the last operation
 const (
 	OperationNameKey        = "last-operation-name"
 	OperationStateKey       = "last-operation-state"
@@ -58,21 +70,67 @@ const (
 const (
 	OperationPrefixProvision   = "provision-"
 	OperationPrefixDeprovision = "deprovision-"
+	OperationPrefixUpdate      = "update-"
+	OperationPrefixBind        = "bind-"
+	OperationPrefixUnbind      = "unbind-"
 )
 
 type Client struct {
 	helm                      *minibrokerhelm.Client
+	releases                  minibrokerhelm.ReleaseManager
+	catalog                   *Catalog
+	schemas                   *schemaCache
+	plans                     *planIndex
+	namespaces                *namespaceGuard
 	namespace                 string
 	coreClient                kubernetes.Interface
 	providers                 map[string]Provider
 	serviceCatalogEnabledOnly bool
 }
 
-func NewClient(repoURL string, serviceCatalogEnabledOnly bool) *Client {
+func NewClient(repos []minibrokerhelm.Repository, chartCache minibrokerhelm.CacheOptions, helmBackend string, tiller minibrokerhelm.TillerOptions, catalogPath string, serviceCatalogEnabledOnly bool, namespacePolicy NamespacePolicy) (*Client, error) {
+	catalog, err := LoadCatalog(catalogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := newNamespaceGuard(namespacePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	helmClient, err := minibrokerhelm.NewClient(repos, chartCache)
+	if err != nil {
+		return nil, err
+	}
+
+	coreClient := loadInClusterClient()
+	namespace := loadNamespace()
+
+	var releases minibrokerhelm.ReleaseManager
+	switch helmBackend {
+	case minibrokerhelm.BackendTiller, "":
+		tillerReleases, err := minibrokerhelm.NewTillerReleaseManager(tiller)
+		if err != nil {
+			return nil, err
+		}
+		releases = tillerReleases
+	case minibrokerhelm.BackendSecrets:
+		// The operation timeout applies to both backends
+		releases = minibrokerhelm.NewSecretsReleaseManager(coreClient, namespace, tiller.Timeout)
+	default:
+		return nil, errors.Errorf("unknown helm backend %q", helmBackend)
+	}
+
 	return &Client{
-		helm:                      minibrokerhelm.NewClient(repoURL),
-		coreClient:                loadInClusterClient(),
-		namespace:                 loadNamespace(),
+		helm:                      helmClient,
+		catalog:                   catalog,
+		schemas:                   newSchemaCache(),
+		plans:                     &planIndex{},
+		namespaces:                namespaces,
+		releases:                  releases,
+		coreClient:                coreClient,
+		namespace:                 namespace,
 		serviceCatalogEnabledOnly: serviceCatalogEnabledOnly,
 		providers: map[string]Provider{
 			"mysql":      MySQLProvider{},
@@ -81,7 +139,7 @@ func NewClient(repoURL string, serviceCatalogEnabledOnly bool) *Client {
 			"mongodb":    MongodbProvider{},
 			"redis":      RedisProvider{},
 		},
-	}
+	}, nil
 }
 
 func loadInClusterClient() kubernetes.Interface {
@@ -165,6 +223,14 @@ func generateOperationName(prefix string) string {
 	return fmt.Sprintf("%s%x", prefix, rand.Int31())
 }
 
+// releaseNameForInstance returns the name of the release backing an instance,
+// so that the release can be found again if the broker restarts while it is
+// being installed.
+func releaseNameForInstance(instanceID string) string {
+	sum := sha1.Sum([]byte(instanceID))
+	return "minibroker-" + hex.EncodeToString(sum[:])[:12]
+}
+
 func (c *Client) getConfigMap(instanceID string) (*corev1.ConfigMap, error) {
 	configMapInterface := c.coreClient.CoreV1().ConfigMaps(c.namespace)
 	config, err := configMapInterface.Get(instanceID, metav1.GetOptions{})
@@ -203,28 +269,44 @@ func (c *Client) updateConfigMap(instanceID string, data map[string]interface{})
 
 func (c *Client) ListServices() ([]osb.Service, error) {
 	glog.Info("Listing services...")
-	var services []osb.Service
 
 	charts, err := c.helm.ListCharts()
 	if err != nil {
 		return nil, err
 	}
 
-	for chart, chartVersions := range charts {
-		if _, ok := c.providers[chart]; !ok && c.serviceCatalogEnabledOnly {
+	services, plans := c.catalogServices(charts)
+	c.plans.set(plans)
+
+	glog.Infoln("List complete")
+	return services, nil
+}
+
+// catalogServices generates the services offered for the given charts, with
+// what each of their plans installs.
+func (c *Client) catalogServices(charts map[string]repo.ChartVersions) ([]osb.Service, map[string]planChart) {
+	var services []osb.Service
+	plans := map[string]planChart{}
+	for service, chartVersions := range charts {
+		chart := c.helm.ChartName(service)
+		override, listed := c.catalog.Services[service]
+		if _, ok := c.providers[chart]; !ok && !listed && c.serviceCatalogEnabledOnly {
 			continue
 		}
 
 		tags := getTagIntersection(chartVersions)
 
 		svc := osb.Service{
-			ID:          chart,
-			Name:        chart,
-			Description: "Helm Chart for " + chart,
-			Bindable:    true,
-			Plans:       make([]osb.Plan, 0, len(chartVersions)),
-			Tags:        tags,
+			ID:                  service,
+			Name:                service,
+			Description:         "Helm Chart for " + chart,
+			Bindable:            true,
+			BindingsRetrievable: true,
+			PlanUpdatable:       boolPtr(true),
+			Plans:               make([]osb.Plan, 0, len(chartVersions)),
+			Tags:                tags,
 		}
+		override.apply(&svc)
 		appVersions := map[string]*repo.ChartVersion{}
 		for _, chartVersion := range chartVersions {
 			if chartVersion.AppVersion == "" {
@@ -251,37 +333,74 @@ func (c *Client) ListServices() ([]osb.Service, error) {
 			}
 		}
 
-		for _, chartVersion := range appVersions {
-			planToken := fmt.Sprintf("%s@%s", chart, chartVersion.AppVersion)
-			cleaner := regexp.MustCompile(`[^a-z0-9]`)
-			planID := cleaner.ReplaceAllString(strings.ToLower(planToken), "-")
-			planName := cleaner.ReplaceAllString(chartVersion.AppVersion, "-")
+		// Sorted so that the first app version keeps a plan ID that several
+		// clean to, e.g. 4.0.10-debian and 4.0.10.debian
+		versions := make([]string, 0, len(appVersions))
+		for appVersion := range appVersions {
+			versions = append(versions, appVersion)
+		}
+		sort.Strings(versions)
+
+		for _, appVersion := range versions {
+			chartVersion := appVersions[appVersion]
+			if !override.offers(chartVersion.AppVersion) {
+				continue
+			}
+			planToken := fmt.Sprintf("%s@%s", service, chartVersion.AppVersion)
+			planID := planCleaner.ReplaceAllString(strings.ToLower(planToken), "-")
+			if existing, ok := plans[planKey(service, planID)]; ok {
+				glog.Errorf("Skipping %s@%s: its plan ID %s is already used by %s", service, chartVersion.AppVersion, planID, existing.appVersion)
+				continue
+			}
+			plans[planKey(service, planID)] = planChart{
+				chart:        service,
+				chartVersion: chartVersion.Version,
+				appVersion:   chartVersion.AppVersion,
+			}
+			planName := planCleaner.ReplaceAllString(chartVersion.AppVersion, "-")
 			plan := osb.Plan{
 				ID:          planID,
 				Name:        planName,
 				Description: chartVersion.Description,
 				Free:        boolPtr(true),
+
+				ParameterSchemas: c.catalogSchemas(service, chartVersion.Version),
 			}
+			override.applyPlan(chartVersion.AppVersion, &plan)
 			svc.Plans = append(svc.Plans, plan)
 		}
+		schemas := func(chartVersion string) *osb.ParameterSchemas {
+			return c.catalogSchemas(service, chartVersion)
+		}
+		svc.Plans = append(svc.Plans, override.tierPlans(service, appVersions, schemas, plans)...)
 
 		if len(svc.Plans) == 0 {
 			continue
 		}
 		services = append(services, svc)
 	}
-
-	glog.Infoln("List complete")
-	return services, nil
+	return services, plans
 }
 
 // Provision a new service instance.  Returns the async operation key (if
-// acceptsIncomplete is set).
-func (c *Client) Provision(instanceID, serviceID, planID, namespace string, acceptsIncomplete bool, provisionParams map[string]interface{}) (string, error) {
-	chartName := serviceID
-	// The way I'm turning charts into plans is not reversible
-	chartVersion := strings.Replace(planID, serviceID+"-", "", 1)
-	chartVersion = strings.Replace(chartVersion, "-", ".", -1)
+// acceptsIncomplete is set). The namespace is created when it does not exist
+// if createNamespace is set.
+func (c *Client) Provision(instanceID, serviceID, planID, namespace string, createNamespace, acceptsIncomplete bool, provisionParams map[string]interface{}, identity *OriginatingIdentity) (string, error) {
+	if err := c.checkNamespace(namespace); err != nil {
+		return "", err
+	}
+	plan, err := c.resolvePlan(serviceID, planID)
+	if err != nil {
+		return "", err
+	}
+	chartName := plan.chart
+
+	if err := c.checkParameters(serviceID, plan, provisionParams); err != nil {
+		return "", err
+	}
+	if err := c.checkPolicy(serviceID, provisionParams); err != nil {
+		return "", err
+	}
 
 	glog.Info("persisting the provisioning parameters...")
 	paramsJSON, err := json.Marshal(provisionParams)
@@ -293,17 +412,32 @@ func (c *Client) Provision(instanceID, serviceID, planID, namespace string, acce
 			Name:      instanceID,
 			Namespace: c.namespace,
 			Labels: map[string]string{
-				ServiceKey: serviceID,
-				PlanKey:    planID,
+				ServiceKey:          serviceID,
+				PlanKey:             planID,
+				ReleaseNamespaceKey: namespace,
 			},
 		},
 		Data: map[string]string{
 			ProvisionParamsKey: string(paramsJSON),
 			ServiceKey:         serviceID,
 			PlanKey:            planID,
+			ChartVersionKey:    plan.chartVersion,
 		},
 	}
+	if identity != nil {
+		identityJSON, err := json.Marshal(identity)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not marshall the originating identity %v", identity)
+		}
+		config.Data[OriginatingIdentityKey] = string(identityJSON)
+	}
+	c.namespaces.provisioning.Lock()
+	if err := c.checkQuotas(serviceID, namespace); err != nil {
+		c.namespaces.provisioning.Unlock()
+		return "", err
+	}
 	_, err = c.coreClient.CoreV1().ConfigMaps(config.Namespace).Create(&config)
+	c.namespaces.provisioning.Unlock()
 	if err != nil {
 		// TODO: compare provision parameters and ignore this call if it's the same
 		if apierrors.IsAlreadyExists(err) {
@@ -316,7 +450,7 @@ func (c *Client) Provision(instanceID, serviceID, planID, namespace string, acce
 		return "", errors.Wrapf(err, "could not persist the instance configmap for %q", instanceID)
 	}
 
-	glog.Infof("provisioning %s/%s using stable helm chart %s@%s...", serviceID, planID, chartName, chartVersion)
+	glog.Infof("provisioning %s/%s using helm chart %s@%s...", serviceID, planID, chartName, plan.chartVersion)
 
 	if acceptsIncomplete {
 		operationKey := generateOperationName(OperationPrefixProvision)
@@ -333,27 +467,32 @@ func (c *Client) Provision(instanceID, serviceID, planID, namespace string, acce
 				glog.Errorf("Failed to provision %q: %s", instanceID, err)
 				err = c.updateConfigMap(instanceID, map[string]interface{}{
 					OperationStateKey:       string(osb.StateFailed),
-					OperationDescriptionKey: fmt.Sprintf("service instance %q failed to provision", instanceID),
+					OperationDescriptionKey: failureDescription(fmt.Sprintf("service instance %q failed to provision", instanceID), err),
 				})
 				if err != nil {
 					glog.Errorf("Could not update operation state when provisioning asynchronously: %s", err)
 				}
 			}
 
-			resp, err := c.installRelease(chartName, chartVersion, namespace, provisionParams, helm.InstallWait(true))
+			ch, err := c.loadValidChart(serviceID, plan, provisionParams)
+			if err != nil {
+				fail(err)
+				return
+			}
+			rel, err := c.installRelease(ch, plan, releaseNameForInstance(instanceID), namespace, createNamespace, provisionParams, true)
 			if err != nil {
 				fail(err)
 				return
 			}
 
-			err = c.updateProvisioningState(resp.Release.Name, instanceID, resp.Release.Namespace, provisionParams)
+			err = c.updateProvisioningState(rel.Name, instanceID, rel.Namespace, provisionParams)
 			if err != nil {
 				fail(err)
 				return
 			}
 
 			glog.Infof("provision of %v@%v (%v@%v) complete\n%s\n",
-				chartName, chartVersion, resp.Release.Name, resp.Release.Version, spew.Sdump(resp.Release.Manifest))
+				chartName, plan.chartVersion, rel.Name, rel.Version, spew.Sdump(rel.Manifest))
 			err = c.updateConfigMap(instanceID, map[string]interface{}{
 				OperationStateKey:       string(osb.StateSucceeded),
 				OperationDescriptionKey: fmt.Sprintf("service instance %q provisioned", instanceID),
@@ -365,12 +504,16 @@ func (c *Client) Provision(instanceID, serviceID, planID, namespace string, acce
 		return operationKey, nil
 	}
 
-	resp, err := c.installRelease(chartName, chartVersion, namespace, provisionParams)
+	ch, err := c.loadValidChart(serviceID, plan, provisionParams)
+	if err != nil {
+		return "", err
+	}
+	rel, err := c.installRelease(ch, plan, releaseNameForInstance(instanceID), namespace, createNamespace, provisionParams, false)
 	if err != nil {
 		return "", err
 	}
 
-	err = c.updateProvisioningState(resp.Release.Name, instanceID, resp.Release.Namespace, provisionParams)
+	err = c.updateProvisioningState(rel.Name, instanceID, rel.Namespace, provisionParams)
 	if err != nil {
 		return "", err
 	}
@@ -378,40 +521,187 @@ func (c *Client) Provision(instanceID, serviceID, planID, namespace string, acce
 	return "", nil
 }
 
-func (c *Client) installRelease(
-	chartName string,
-	chartVersion string,
-	namespace string,
-	provisionParams map[string]interface{},
-	opts ...helm.InstallOption,
-) (*rls.InstallReleaseResponse, error) {
-	chartDef, err := c.helm.GetChart(chartName, chartVersion)
+// planCleaner matches the characters that are replaced in plan IDs.
+var planCleaner = regexp.MustCompile(`[^a-z0-9]`)
+
+// planChart is what a plan installs.
+type planChart struct {
+	// chart is the name of the chart, qualified by its repository
+	chart string
+	// chartVersion is the exact version of the chart installed
+	chartVersion string
+	appVersion   string
+	// values are applied underneath the parameters of the instance
+	values map[string]interface{}
+}
+
+// planIndex maps the plans of the last generated catalog to what they
+// install, so that plans never have to be parsed back from their IDs.
+type planIndex struct {
+	mu    sync.RWMutex
+	plans map[string]planChart
+}
+
+func planKey(serviceID, planID string) string {
+	return serviceID + "/" + planID
+}
+
+func (i *planIndex) set(plans map[string]planChart) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.plans = plans
+}
+
+// get returns what a plan installs, and whether the index was built at all.
+func (i *planIndex) get(serviceID, planID string) (plan planChart, found, built bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	plan, found = i.plans[planKey(serviceID, planID)]
+	return plan, found, i.plans != nil
+}
+
+// resolvePlan returns what the given plan installs. Unknown plans are a 400
+// error.
+func (c *Client) resolvePlan(serviceID, planID string) (planChart, error) {
+	plan, found, built := c.plans.get(serviceID, planID)
+	if !found && !built {
+		// Nothing was listed since minibroker started
+		if _, err := c.ListServices(); err != nil {
+			return planChart{}, err
+		}
+		plan, found, _ = c.plans.get(serviceID, planID)
+	}
+	if !found {
+		msg := fmt.Sprintf("unknown plan %q of service %q", planID, serviceID)
+		return planChart{}, osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusBadRequest,
+			Description: &msg,
+		}
+	}
+	return plan, nil
+}
+
+// isUnknownPlan reports whether resolvePlan failed because the plan is not
+// offered.
+func isUnknownPlan(err error) bool {
+	statusErr, ok := err.(osb.HTTPStatusCodeError)
+	return ok && statusErr.StatusCode == http.StatusBadRequest
+}
+
+// installedPlan returns what the release of an instance installs, for
+// instances whose plan is no longer offered. The values of the release are
+// kept underneath the parameters, as they hold those of a tier.
+func (c *Client) installedPlan(serviceID, releaseName, chartVersion string) (planChart, error) {
+	rel, err := c.releases.GetRelease(releaseName)
 	if err != nil {
-		return nil, err
+		return planChart{}, errors.Wrapf(err, "could not get release %s", releaseName)
+	}
+	if chartVersion == "" {
+		// Instances provisioned before chart versions were recorded
+		chartVersion = rel.GetChart().GetMetadata().GetVersion()
+	}
+	values, err := chartutil.ReadValues([]byte(rel.GetConfig().GetRaw()))
+	if err != nil {
+		return planChart{}, errors.Wrapf(err, "could not parse the values of release %s", releaseName)
 	}
+	return planChart{
+		chart:        serviceID,
+		chartVersion: chartVersion,
+		appVersion:   rel.GetChart().GetMetadata().GetAppVersion(),
+		values:       values,
+	}, nil
+}
 
-	tc, err := c.connectTiller()
+// PlanChartVersion returns the version of the chart a plan installs.
+func (c *Client) PlanChartVersion(serviceID, planID string) (string, error) {
+	plan, err := c.resolvePlan(serviceID, planID)
+	if err != nil {
+		return "", err
+	}
+	return plan.chartVersion, nil
+}
+
+// releaseValues returns the values of a release installed from the plan with
+// the given parameters.
+func releaseValues(plan planChart, params map[string]interface{}) ([]byte, error) {
+	values := params
+	if plan.values != nil {
+		values = mergeValues(plan.values, params)
+	}
+	valuesYaml, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not marshall the values %v", values)
+	}
+	return valuesYaml, nil
+}
+
+// loadChart downloads the chart a plan installs.
+func (c *Client) loadChart(plan planChart) (*chart.Chart, error) {
+	chartDef, err := c.helm.GetChart(plan.chart, plan.chartVersion)
 	if err != nil {
 		return nil, err
 	}
 
-	chart, err := minibrokerhelm.LoadChart(chartDef)
+	return c.helm.LoadChart(chartDef)
+}
+
+// loadValidChart downloads the chart a plan installs and checks the
+// parameters of an instance against its values schema, caching the schemas
+// of the plan on the way.
+func (c *Client) loadValidChart(serviceID string, plan planChart, params map[string]interface{}) (*chart.Chart, error) {
+	ch, err := c.loadChart(plan)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.chartSchemas(serviceID, plan.chartVersion, ch).validate(params); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
 
-	valuesYaml, err := yaml.Marshal(provisionParams)
+// checkParameters checks the parameters of an instance against the
+// parameters known to the provider, and against the schema of the chart when
+// it was already downloaded. Otherwise the chart schema is checked when
+// installing it.
+func (c *Client) checkParameters(serviceID string, plan planChart, params map[string]interface{}) error {
+	if err := validateParameters(c.buildSchemas(serviceID, nil).provision, params); err != nil {
+		return err
+	}
+	if schemas := c.schemas.get(schemaKey(serviceID, plan.chartVersion)); schemas != nil {
+		return schemas.validate(params)
+	}
+	return nil
+}
+
+// failureDescription describes the failure of an asynchronous operation,
+// along with the parameters that were invalid, which users need to fix.
+func failureDescription(description string, err error) string {
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); ok && statusErr.StatusCode == http.StatusBadRequest && statusErr.Description != nil {
+		return fmt.Sprintf("%s: %s", description, *statusErr.Description)
+	}
+	return description
+}
+
+func (c *Client) installRelease(
+	ch *chart.Chart,
+	plan planChart,
+	releaseName string,
+	namespace string,
+	createNamespace bool,
+	provisionParams map[string]interface{},
+	wait bool,
+) (*release.Release, error) {
+	valuesYaml, err := releaseValues(plan, provisionParams)
 	if err != nil {
 		return nil, err
 	}
-	allOpts := []helm.InstallOption{
-		helm.ValueOverrides(valuesYaml),
-		helm.InstallReuseName(true),
-		helm.InstallDisableHooks(true),
+	if createNamespace {
+		if err := c.ensureNamespace(namespace); err != nil {
+			return nil, err
+		}
 	}
-	allOpts = append(allOpts, opts...)
-	glog.Infof("Installing release %s on namespace %s...", chart, namespace)
-	return tc.InstallReleaseFromChart(chart, namespace, allOpts...)
+	glog.Infof("Installing release %s on namespace %s...", ch, namespace)
+	return c.releases.InstallRelease(ch, releaseName, namespace, valuesYaml, wait)
 }
 
 func (c *Client) updateProvisioningState(
@@ -510,22 +800,18 @@ func (c *Client) labelSecret(secret corev1.Secret, instanceID string) error {
 	return nil
 }
 
-func (c *Client) connectTiller() (*helm.Client, error) {
-	glog.Infof("Connecting to tiller at localhost...")
-
-	tc := helm.NewClient(helm.Host("localhost:44134"))
-
-	err := tc.PingTiller()
-	if err != nil {
-		return nil, err
-	}
-
-	glog.Infoln("Connected!")
-
-	return tc, nil
+// releaseResources holds what is needed to compute the credentials of a
+// release.
+type releaseResources struct {
+	namespace string
+	params    map[string]interface{}
+	services  []corev1.Service
+	secrets   map[string]interface{}
+	// secretNames are the names of the secrets holding each key of secrets
+	secretNames map[string]string
 }
 
-func (c *Client) Bind(instanceID, serviceID string, bindParams map[string]interface{}) (map[string]interface{}, error) {
+func (c *Client) getReleaseResources(instanceID string, bindParams map[string]interface{}) (*releaseResources, error) {
 	config, err := c.coreClient.CoreV1().ConfigMaps(c.namespace).Get(instanceID, metav1.GetOptions{})
 	if err != nil {
 		if apierrors.IsNotFound(err) {
@@ -578,25 +864,551 @@ func (c *Client) Bind(instanceID, serviceID string, bindParams map[string]interf
 	}
 
 	data := make(map[string]interface{})
+	secretNames := make(map[string]string)
 	for _, secret := range secrets.Items {
 		for key, value := range secret.Data {
 			data[key] = string(value)
+			secretNames[key] = secret.Name
+		}
+	}
+
+	return &releaseResources{
+		namespace: releaseNamespace,
+		params:    params,
+		services:  services.Items,
+		secrets:   data,
+
+		secretNames: secretNames,
+	}, nil
+}
+
+// Bind returns the credentials of the given binding, creating the binding if
+// it does not exist yet. The returned boolean reports whether an identical
+// binding already existed. When acceptsIncomplete is set the binding is
+// created asynchronously and the response carries the operation key instead
+// of the credentials.
+func (c *Client) Bind(instanceID, serviceID, planID, bindingID string, acceptsIncomplete bool, bindParams map[string]interface{}) (*osb.BindResponse, bool, error) {
+	paramsJSON, err := marshalBindParams(bindParams)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := validateParameters(c.buildSchemas(serviceID, nil).bind, bindParams); err != nil {
+		return nil, false, err
+	}
+
+	secret, err := c.getBindingSecret(bindingID)
+	if err != nil {
+		return nil, false, err
+	}
+	if secret != nil {
+		if !sameBinding(secret, instanceID, serviceID, planID, paramsJSON) {
+			return nil, false, bindingConflictError(bindingID)
+		}
+		creds, err := bindingCredentials(secret)
+		if err != nil {
+			return nil, false, err
+		}
+		if creds != nil {
+			return &osb.BindResponse{Credentials: creds}, true, nil
+		}
+		if string(secret.Data[OperationStateKey]) == string(osb.StateInProgress) {
+			if !acceptsIncomplete {
+				return nil, false, osb.HTTPStatusCodeError{
+					StatusCode:   http.StatusUnprocessableEntity,
+					ErrorMessage: &[]string{ConcurrencyErrorMessage}[0],
+					Description:  &[]string{ConcurrencyErrorDescription}[0],
+				}
+			}
+			operationKey := osb.OperationKey(secret.Data[OperationNameKey])
+			return &osb.BindResponse{Async: true, OperationKey: &operationKey}, false, nil
+		}
+	}
+
+	resources, err := c.getReleaseResources(instanceID, bindParams)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if secret == nil {
+		data := map[string]string{
+			BindingParamsKey: paramsJSON,
+			ServiceKey:       serviceID,
+			PlanKey:          planID,
+		}
+		if _, ok := c.providers[c.helm.ChartName(serviceID)].(UserProvider); ok {
+			password, err := generatePassword()
+			if err != nil {
+				return nil, false, err
+			}
+			data[BindingUsernameKey] = generateUsername(bindingID)
+			data[BindingPasswordKey] = password
+		}
+		secret, err = c.createBindingSecret(instanceID, bindingID, data)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if acceptsIncomplete {
+		operationKey := generateOperationName(OperationPrefixBind)
+		secret, err = c.updateBindingSecret(secret, map[string]interface{}{
+			OperationStateKey:       string(osb.StateInProgress),
+			OperationNameKey:        operationKey,
+			OperationDescriptionKey: fmt.Sprintf("binding %q", bindingID),
+		})
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "Failed to set operation key when binding %s", bindingID)
+		}
+		go c.finishBinding(instanceID, serviceID, secret, resources)
+		key := osb.OperationKey(operationKey)
+		return &osb.BindResponse{Async: true, OperationKey: &key}, false, nil
+	}
+
+	_, creds, err := c.completeBinding(instanceID, serviceID, secret, resources)
+	if err != nil {
+		return nil, false, err
+	}
+	return &osb.BindResponse{Credentials: creds}, false, nil
+}
+
+// completeBinding computes the credentials of a binding and stores them in
+// the binding secret. It returns the updated secret along with the
+// credentials; on failure the secret is returned unchanged.
+func (c *Client) completeBinding(instanceID, serviceID string, secret *corev1.Secret, resources *releaseResources) (*corev1.Secret, map[string]interface{}, error) {
+	bindingID := secret.Name
+	provider, hasProvider := c.providers[c.helm.ChartName(serviceID)]
+	userProvider, hasUsers := provider.(UserProvider)
+
+	var data map[string]interface{}
+
+	// Prefer a dedicated user for the binding over the chart credentials
+	if _, ok := secret.Data[BindingUsernameKey]; ok && hasUsers {
+		creds, err := c.createBindingUser(userProvider, secret, resources)
+		if err == nil {
+			data = creds.ToMap()
+		} else if errors.Cause(err) == ErrUserNotSupported {
+			glog.Infof("Instance %s does not support users, sharing the chart credentials", instanceID)
+			updated, err := c.updateBindingSecret(secret, map[string]interface{}{
+				BindingUsernameKey: nil,
+				BindingPasswordKey: nil,
+			})
+			if err != nil {
+				return secret, nil, err
+			}
+			secret = updated
+		} else {
+			return secret, nil, errors.Wrapf(err, "unable to create user for binding %s", bindingID)
+		}
+	}
+
+	if data == nil {
+		data = resources.secrets
+
+		// Apply additional provisioning logic for Service Catalog Enabled services
+		if hasProvider {
+			creds, err := provider.Bind(resources.services, resources.params, data)
+			if err != nil {
+				return secret, nil, errors.Wrapf(err, "unable to bind instance %s", instanceID)
+			}
+			for k, v := range creds.ToMap() {
+				data[k] = v
+			}
+		}
+	}
+
+	credsJSON, err := json.Marshal(data)
+	if err != nil {
+		return secret, nil, errors.Wrapf(err, "could not marshall credentials of binding %q", bindingID)
+	}
+	updated, err := c.updateBindingSecret(secret, map[string]interface{}{
+		BindingCredentialsKey: string(credsJSON),
+	})
+	if err != nil {
+		return secret, nil, err
+	}
+
+	return updated, data, nil
+}
+
+// finishBinding completes an asynchronous binding and records the outcome of
+// the operation.
+func (c *Client) finishBinding(instanceID, serviceID string, secret *corev1.Secret, resources *releaseResources) {
+	bindingID := secret.Name
+	secret, _, err := c.completeBinding(instanceID, serviceID, secret, resources)
+	state := map[string]interface{}{
+		OperationStateKey:       string(osb.StateSucceeded),
+		OperationDescriptionKey: fmt.Sprintf("binding %q created", bindingID),
+	}
+	if err != nil {
+		glog.Errorf("Failed to bind %q: %s", bindingID, err)
+		state = map[string]interface{}{
+			OperationStateKey:       string(osb.StateFailed),
+			OperationDescriptionKey: fmt.Sprintf("binding %q failed: %s", bindingID, err),
+		}
+	}
+	if _, err = c.updateBindingSecret(secret, state); err != nil {
+		glog.Errorf("Could not update operation state when binding asynchronously: %s", err)
+	}
+}
+
+// GetBinding returns the stored credentials and parameters of a binding.
+func (c *Client) GetBinding(instanceID, bindingID string) (*osb.GetBindingResponse, error) {
+	secret, err := c.getBindingSecret(bindingID)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Labels[InstanceLabel] != instanceID {
+		return nil, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound}
+	}
+
+	creds, err := bindingCredentials(secret)
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		// The binding has not completed yet
+		return nil, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound}
+	}
+
+	var params map[string]interface{}
+	err = json.Unmarshal(secret.Data[BindingParamsKey], &params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshall parameters of binding %q", bindingID)
+	}
+
+	return &osb.GetBindingResponse{
+		Credentials: creds,
+		Parameters:  params,
+	}, nil
+}
+
+// Unbind deletes the binding and the user created for it, if any. Returns the
+// async operation key (if acceptsIncomplete is set).
+func (c *Client) Unbind(instanceID, serviceID, bindingID string, acceptsIncomplete bool) (string, error) {
+	secret, err := c.getBindingSecret(bindingID)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Labels[InstanceLabel] != instanceID {
+		return "", osb.HTTPStatusCodeError{StatusCode: http.StatusGone}
+	}
+
+	if !acceptsIncomplete {
+		return "", c.unbindSynchronously(instanceID, serviceID, secret)
+	}
+
+	operationKey := generateOperationName(OperationPrefixUnbind)
+	secret, err = c.updateBindingSecret(secret, map[string]interface{}{
+		OperationStateKey:       string(osb.StateInProgress),
+		OperationNameKey:        operationKey,
+		OperationDescriptionKey: fmt.Sprintf("unbinding %q", bindingID),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to set operation key when unbinding %s", bindingID)
+	}
+	go func() {
+		err := c.unbindSynchronously(instanceID, serviceID, secret)
+		if err == nil {
+			// After unbinding, there is no secret to update
+			return
+		}
+		glog.Errorf("Failed to unbind %q: %s", bindingID, err)
+		_, err = c.updateBindingSecret(secret, map[string]interface{}{
+			OperationStateKey:       string(osb.StateFailed),
+			OperationDescriptionKey: fmt.Sprintf("binding %q failed to unbind", bindingID),
+		})
+		if err != nil {
+			glog.Errorf("Could not update operation state when unbinding asynchronously: %s", err)
+		}
+	}()
+	return operationKey, nil
+}
+
+func (c *Client) unbindSynchronously(instanceID, serviceID string, secret *corev1.Secret) error {
+	bindingID := secret.Name
+	if userProvider, ok := c.providers[c.helm.ChartName(serviceID)].(UserProvider); ok {
+		if _, ok := secret.Data[BindingUsernameKey]; ok {
+			resources, err := c.getReleaseResources(instanceID, nil)
+			if err != nil {
+				return err
+			}
+			err = c.dropBindingUser(userProvider, secret, resources)
+			if err != nil {
+				return errors.Wrapf(err, "unable to drop user for binding %s", bindingID)
+			}
 		}
 	}
 
-	// Apply additional provisioning logic for Service Catalog Enabled services
-	provider, ok := c.providers[serviceID]
-	if ok {
-		creds, err := provider.Bind(services.Items, params, data)
+	return c.deleteBindingSecret(bindingID)
+}
+
+// BindingLastOperationState returns the status of the last asynchronous
+// operation on a binding.
+func (c *Client) BindingLastOperationState(instanceID, bindingID string, operationKey *osb.OperationKey) (*osb.LastOperationResponse, error) {
+	secret, err := c.getBindingSecret(bindingID)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Labels[InstanceLabel] != instanceID {
+		glog.V(5).Infof("last operation on missing binding \"%s\"", bindingID)
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode: http.StatusGone,
+		}
+	}
+
+	if operationKey != nil && string(secret.Data[OperationNameKey]) != string(*operationKey) {
+		// Got unexpected operation key
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: &[]string{ConcurrencyErrorMessage}[0],
+			Description:  &[]string{ConcurrencyErrorDescription}[0],
+		}
+	}
+
+	description := string(secret.Data[OperationDescriptionKey])
+	return &osb.LastOperationResponse{
+		State:       osb.LastOperationState(secret.Data[OperationStateKey]),
+		Description: &description,
+	}, nil
+}
+
+// Instance describes a provisioned service instance.
+type Instance struct {
+	ServiceID    string
+	PlanID       string
+	ChartVersion string
+	Parameters   map[string]interface{}
+}
+
+// GetInstance returns the service, plan and parameters the instance was
+// provisioned (or last updated) with.
+func (c *Client) GetInstance(instanceID string) (*Instance, error) {
+	config, err := c.coreClient.CoreV1().ConfigMaps(c.namespace).Get(instanceID, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound}
+		}
+		return nil, err
+	}
+
+	operationName := config.Data[OperationNameKey]
+	if config.Data[OperationStateKey] == string(osb.StateInProgress) &&
+		(strings.HasPrefix(operationName, OperationPrefixProvision) || strings.HasPrefix(operationName, OperationPrefixUpdate)) {
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode:   http.StatusUnprocessableEntity,
+			ErrorMessage: &[]string{ConcurrencyErrorMessage}[0],
+			Description:  &[]string{ConcurrencyErrorDescription}[0],
+		}
+	}
+
+	var params map[string]interface{}
+	err = json.Unmarshal([]byte(config.Data[ProvisionParamsKey]), &params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshall provision parameters for instance %q", instanceID)
+	}
+
+	return &Instance{
+		ServiceID:    config.Data[ServiceKey],
+		PlanID:       config.Data[PlanKey],
+		ChartVersion: config.Data[ChartVersionKey],
+		Parameters:   params,
+	}, nil
+}
+
+// Update changes the plan and/or the parameters of an existing service
+// instance by upgrading its release. Returns the async operation key (if
+// acceptsIncomplete is set).
+func (c *Client) Update(instanceID, serviceID string, planID *string, acceptsIncomplete bool, updateParams map[string]interface{}) (string, error) {
+	config, err := c.coreClient.CoreV1().ConfigMaps(c.namespace).Get(instanceID, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			msg := fmt.Sprintf("could not find configmap %s/%s", c.namespace, instanceID)
+			return "", osb.HTTPStatusCodeError{
+				StatusCode:   http.StatusNotFound,
+				ErrorMessage: &msg,
+			}
+		}
+		return "", err
+	}
+
+	release := config.Data[ReleaseLabel]
+	if release == "" || config.Data[OperationStateKey] == string(osb.StateInProgress) {
+		return "", osb.HTTPStatusCodeError{
+			StatusCode:   http.StatusUnprocessableEntity,
+			ErrorMessage: &[]string{ConcurrencyErrorMessage}[0],
+			Description:  &[]string{ConcurrencyErrorDescription}[0],
+		}
+	}
+
+	if serviceID == "" {
+		serviceID = config.Data[ServiceKey]
+	}
+	newPlanID := config.Data[PlanKey]
+	if planID != nil && *planID != "" {
+		newPlanID = *planID
+	}
+	plan, err := c.resolvePlan(serviceID, newPlanID)
+	if isUnknownPlan(err) && newPlanID == config.Data[PlanKey] {
+		// The plan of the instance is no longer offered, its parameters can
+		// still be updated
+		plan, err = c.installedPlan(serviceID, release, config.Data[ChartVersionKey])
+	}
+	if err != nil {
+		return "", err
+	}
+	chartName := plan.chart
+
+	var provisionParams map[string]interface{}
+	err = json.Unmarshal([]byte(config.Data[ProvisionParamsKey]), &provisionParams)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not unmarshall provision parameters for instance %q", instanceID)
+	}
+	params := mergeValues(provisionParams, updateParams)
+
+	if err := c.checkParameters(serviceID, plan, params); err != nil {
+		return "", err
+	}
+	if err := c.checkPolicy(serviceID, updateParams); err != nil {
+		return "", err
+	}
+
+	glog.Infof("updating %s/%s from helm chart version %s to %s@%s...",
+		serviceID, newPlanID, config.Data[ChartVersionKey], chartName, plan.chartVersion)
+
+	if acceptsIncomplete {
+		paramsJSON, err := json.Marshal(params)
 		if err != nil {
-			return nil, errors.Wrapf(err, "unable to bind instance %s", instanceID)
+			return "", errors.Wrapf(err, "could not marshall provisioning parameters %v", params)
 		}
-		for k, v := range creds.ToMap() {
-			data[k] = v
+		operationKey := generateOperationName(OperationPrefixUpdate)
+		err = c.updateConfigMap(instanceID, map[string]interface{}{
+			OperationStateKey:       string(osb.StateInProgress),
+			OperationNameKey:        operationKey,
+			OperationDescriptionKey: fmt.Sprintf("updating service instance %q", instanceID),
+			UpdatePlanKey:           newPlanID,
+			UpdateParamsKey:         string(paramsJSON),
+		})
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to set operation key when updating instance %s", instanceID)
 		}
+		go func() {
+			fail := func(err error) {
+				glog.Errorf("Failed to update %q: %s", instanceID, err)
+				err = c.updateConfigMap(instanceID, map[string]interface{}{
+					OperationStateKey:       string(osb.StateFailed),
+					OperationDescriptionKey: failureDescription(fmt.Sprintf("service instance %q failed to update", instanceID), err),
+					UpdatePlanKey:           nil,
+					UpdateParamsKey:         nil,
+				})
+				if err != nil {
+					glog.Errorf("Could not update operation state when updating asynchronously: %s", err)
+				}
+			}
+
+			ch, err := c.loadValidChart(serviceID, plan, params)
+			if err != nil {
+				fail(err)
+				return
+			}
+			rel, err := c.upgradeRelease(release, ch, plan, params, true)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			err = c.updateUpdatingState(instanceID, newPlanID, plan.chartVersion, params)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			glog.Infof("update of %v@%v (%v@%v) complete", chartName, plan.chartVersion, rel.Name, rel.Version)
+			err = c.updateConfigMap(instanceID, map[string]interface{}{
+				OperationStateKey:       string(osb.StateSucceeded),
+				OperationDescriptionKey: fmt.Sprintf("service instance %q updated", instanceID),
+			})
+			if err != nil {
+				glog.Errorf("Could not update operation state when updating asynchronously: %s", err)
+			}
+		}()
+		return operationKey, nil
+	}
+
+	ch, err := c.loadValidChart(serviceID, plan, params)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.upgradeRelease(release, ch, plan, params, false)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.updateUpdatingState(instanceID, newPlanID, plan.chartVersion, params)
+	if err != nil {
+		return "", err
 	}
 
-	return data, nil
+	return "", nil
+}
+
+func (c *Client) upgradeRelease(
+	releaseName string,
+	ch *chart.Chart,
+	plan planChart,
+	params map[string]interface{},
+	wait bool,
+) (*release.Release, error) {
+	valuesYaml, err := releaseValues(plan, params)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Upgrading release %s to %s...", releaseName, ch)
+	return c.releases.UpgradeRelease(releaseName, ch, valuesYaml, wait)
+}
+
+// updateUpdatingState records the plan, the chart version and the merged
+// parameters of an instance once its release has been upgraded.
+func (c *Client) updateUpdatingState(instanceID, planID, chartVersion string, params map[string]interface{}) error {
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return errors.Wrapf(err, "could not marshall provisioning parameters %v", params)
+	}
+
+	config, err := c.getConfigMap(instanceID)
+	if err != nil {
+		return err
+	}
+	config.Labels[PlanKey] = planID
+	config.Data[PlanKey] = planID
+	config.Data[ChartVersionKey] = chartVersion
+	config.Data[ProvisionParamsKey] = string(paramsJSON)
+	delete(config.Data, UpdatePlanKey)
+	delete(config.Data, UpdateParamsKey)
+
+	_, err = c.coreClient.CoreV1().ConfigMaps(c.namespace).Update(config)
+	if err != nil {
+		return errors.Wrapf(err, "could not update the instance configmap for %q", instanceID)
+	}
+	return nil
+}
+
+// mergeValues returns a copy of base with overrides deeply merged on top of it,
+// the same way helm merges values files.
+func mergeValues(base, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		if overrideMap, ok := v.(map[string]interface{}); ok {
+			if baseMap, ok := merged[k].(map[string]interface{}); ok {
+				merged[k] = mergeValues(baseMap, overrideMap)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
 }
 
 func (c *Client) Deprovision(instanceID string, acceptsIncomplete bool) (string, error) {
@@ -608,9 +1420,14 @@ func (c *Client) Deprovision(instanceID string, acceptsIncomplete bool) (string,
 		return "", err
 	}
 	release := config.Data[ReleaseLabel]
+	if release == "" {
+		// Failed provisions do not record the release they installed
+		release = releaseNameForInstance(instanceID)
+	}
+	serviceID := config.Data[ServiceKey]
 
 	if !acceptsIncomplete {
-		err = c.deprovisionSynchronously(instanceID, release)
+		err = c.deprovisionSynchronously(instanceID, serviceID, release)
 		if err != nil {
 			return "", err
 		}
@@ -627,7 +1444,7 @@ func (c *Client) Deprovision(instanceID string, acceptsIncomplete bool) (string,
 		return "", errors.Wrapf(err, "Failed to set operation key when deprovisioning instance %s", instanceID)
 	}
 	go func() {
-		err = c.deprovisionSynchronously(instanceID, release)
+		err = c.deprovisionSynchronously(instanceID, serviceID, release)
 		if err == nil {
 			// After deprovisioning, there is no config map to update
 			return
@@ -644,25 +1461,23 @@ func (c *Client) Deprovision(instanceID string, acceptsIncomplete bool) (string,
 	return operationKey, nil
 }
 
-func (c *Client) deprovisionSynchronously(instanceID, release string) error {
-	tc, err := c.connectTiller()
+func (c *Client) deprovisionSynchronously(instanceID, serviceID, release string) error {
+	err := c.deleteBindings(instanceID, serviceID)
 	if err != nil {
 		return err
 	}
 
 	glog.Infof("Deleting release %s", release)
 
-	opts := []helm.DeleteOption{
-		helm.DeleteDisableHooks(false),
-		helm.DeletePurge(true),
-	}
-	_, err = tc.DeleteRelease(release, opts...)
-	if err != nil {
+	err = c.releases.DeleteRelease(release)
+	if isReleaseNotFound(err) {
+		glog.Infof("Release %s was already deleted", release)
+	} else if err != nil {
 		return errors.Wrapf(err, "could not delete release %s", release)
+	} else {
+		glog.Infof("Release %s deleted", release)
 	}
 
-	glog.Infof("Release %s deleted", release)
-
 	err = c.coreClient.CoreV1().ConfigMaps(c.namespace).Delete(instanceID, &metav1.DeleteOptions{})
 	if err != nil {
 		return errors.Wrapf(err, "could not delete configmap %s/%s", c.namespace, instanceID)
@@ -1,8 +1,24 @@
 package minibroker
 
 import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/ptypes/any"
+	minibrokerhelm "github.com/kubernetes-sigs/minibroker/pkg/helm"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/repo"
 )
@@ -86,3 +102,984 @@ func TestGetTagIntersection(t *testing.T) {
 		}
 	}
 }
+
+func TestMergeValues(t *testing.T) {
+	mergeTests := []struct {
+		base      map[string]interface{}
+		overrides map[string]interface{}
+		expected  map[string]interface{}
+	}{
+		{nil, nil, map[string]interface{}{}},
+		{
+			map[string]interface{}{"mysqlDatabase": "mydb"},
+			map[string]interface{}{"mysqlUser": "admin"},
+			map[string]interface{}{"mysqlDatabase": "mydb", "mysqlUser": "admin"},
+		},
+		{
+			map[string]interface{}{"db": map[string]interface{}{"name": "mydb", "user": "admin"}},
+			map[string]interface{}{"db": map[string]interface{}{"user": "other"}},
+			map[string]interface{}{"db": map[string]interface{}{"name": "mydb", "user": "other"}},
+		},
+		{
+			map[string]interface{}{"db": map[string]interface{}{"name": "mydb"}},
+			map[string]interface{}{"db": "flat"},
+			map[string]interface{}{"db": "flat"},
+		},
+	}
+
+	for _, tt := range mergeTests {
+		actual := mergeValues(tt.base, tt.overrides)
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("mergeValues(%v, %v): expected %v, actual %v",
+				tt.base, tt.overrides, tt.expected, actual)
+		}
+	}
+}
+
+func TestGenerateUsername(t *testing.T) {
+	user := generateUsername("binding-1")
+	if len(user) > 16 {
+		t.Errorf("generateUsername: %q is longer than 16 characters", user)
+	}
+	if again := generateUsername("binding-1"); again != user {
+		t.Errorf("generateUsername: expected %q, actual %q", user, again)
+	}
+	if other := generateUsername("binding-2"); other == user {
+		t.Errorf("generateUsername: %q is not unique per binding", other)
+	}
+}
+
+// recordingRunner records the commands providers run instead of running them.
+type recordingRunner struct {
+	commands  [][]string
+	secretEnv []map[string]string
+	scripts   []string
+}
+
+func (r *recordingRunner) Run(command []string, secretEnv map[string]string, script string) (string, error) {
+	r.commands = append(r.commands, command)
+	r.secretEnv = append(r.secretEnv, secretEnv)
+	r.scripts = append(r.scripts, script)
+	return "OK", nil
+}
+
+func TestUserCommandsKeepCredentialsOut(t *testing.T) {
+	services := []corev1.Service{{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"role": "master"},
+			Ports:    []corev1.ServicePort{{Name: "db", Port: 1234}},
+		},
+	}}
+	chartSecrets := map[string]interface{}{
+		"mysql-root-password":          "chart-secret",
+		"mariadb-root-password":        "chart-secret",
+		"postgresql-password":          "chart-secret",
+		"postgresql-postgres-password": "chart-secret",
+		"mongodb-root-password":        "chart-secret",
+		"redis-password":               "chart-secret",
+	}
+	tests := []struct {
+		name      string
+		provider  UserProvider
+		secretEnv map[string]string
+	}{
+		{"mysql", MySQLProvider{}, map[string]string{"MYSQL_PWD": "mysql-root-password"}},
+		{"mariadb", MariadbProvider{}, map[string]string{"MYSQL_PWD": "mariadb-root-password"}},
+		{"postgresql", PostgresProvider{}, map[string]string{"PGPASSWORD": "postgresql-postgres-password"}},
+		{"mongodb", MongodbProvider{}, nil},
+		{"redis", RedisProvider{}, map[string]string{"REDISCLI_AUTH": "redis-password"}},
+	}
+	for _, tt := range tests {
+		runner := &recordingRunner{}
+		if _, err := tt.provider.CreateUser(runner, services, nil, chartSecrets, "mbuser", "user-secret"); err != nil {
+			t.Errorf("%s: unexpected error creating user: %s", tt.name, err)
+			continue
+		}
+		if err := tt.provider.DropUser(runner, services, nil, chartSecrets, "mbuser"); err != nil {
+			t.Errorf("%s: unexpected error dropping user: %s", tt.name, err)
+			continue
+		}
+		for i, command := range runner.commands {
+			for _, arg := range command {
+				if strings.Contains(arg, "secret") {
+					t.Errorf("%s: credentials in the arguments of %v", tt.name, command)
+				}
+			}
+			if !reflect.DeepEqual(runner.secretEnv[i], tt.secretEnv) {
+				t.Errorf("%s: expected environment %v, actual %v", tt.name, tt.secretEnv, runner.secretEnv[i])
+			}
+		}
+		if !strings.Contains(runner.scripts[0], "user-secret") {
+			t.Errorf("%s: expected the user password in the script, actual %q", tt.name, runner.scripts[0])
+		}
+	}
+}
+
+func TestMarshalBindParams(t *testing.T) {
+	paramsTests := []struct {
+		params   map[string]interface{}
+		expected string
+	}{
+		{nil, "{}"},
+		{map[string]interface{}{}, "{}"},
+		{map[string]interface{}{"b": "2", "a": "1"}, `{"a":"1","b":"2"}`},
+	}
+
+	for _, tt := range paramsTests {
+		actual, err := marshalBindParams(tt.params)
+		if err != nil {
+			t.Errorf("marshalBindParams(%v): unexpected error %s", tt.params, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("marshalBindParams(%v): expected %s, actual %s",
+				tt.params, tt.expected, actual)
+		}
+	}
+}
+
+func TestSameBinding(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{InstanceLabel: "instance"}},
+		Data: map[string][]byte{
+			BindingParamsKey: []byte("{}"),
+			ServiceKey:       []byte("mysql"),
+			PlanKey:          []byte("5-7-14"),
+		},
+	}
+	unrecorded := secret.DeepCopy()
+	delete(unrecorded.Data, ServiceKey)
+	delete(unrecorded.Data, PlanKey)
+
+	tests := []struct {
+		secret                      *corev1.Secret
+		instanceID, serviceID, plan string
+		params                      string
+		expected                    bool
+	}{
+		{secret, "instance", "mysql", "5-7-14", "{}", true},
+		{secret, "other", "mysql", "5-7-14", "{}", false},
+		{secret, "instance", "mariadb", "5-7-14", "{}", false},
+		{secret, "instance", "mysql", "5-7-30", "{}", false},
+		{secret, "instance", "mysql", "5-7-14", `{"a":"1"}`, false},
+		{unrecorded, "instance", "mysql", "5-7-14", "{}", false},
+	}
+	for _, tt := range tests {
+		actual := sameBinding(tt.secret, tt.instanceID, tt.serviceID, tt.plan, tt.params)
+		if actual != tt.expected {
+			t.Errorf("sameBinding(%v, %s, %s, %s, %s): expected %t, actual %t",
+				tt.secret.Data, tt.instanceID, tt.serviceID, tt.plan, tt.params, tt.expected, actual)
+		}
+	}
+}
+
+func TestDeprovision(t *testing.T) {
+	api, coreClient := newFakeAPIServer(t)
+	defer api.close()
+	releases := minibrokerhelm.NewFakeReleaseManager()
+	c := &Client{
+		coreClient: coreClient,
+		namespace:  "minibroker",
+		helm:       &minibrokerhelm.Client{},
+		releases:   releases,
+		providers:  map[string]Provider{},
+	}
+
+	releaseName := releaseNameForInstance("instance")
+	releases.InstallRelease(&chart.Chart{Metadata: &chart.Metadata{Name: "nginx"}}, releaseName, "apps", nil, false)
+	api.add("configmaps", &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "instance",
+			Namespace: "minibroker",
+			Labels:    map[string]string{ServiceKey: "nginx"},
+		},
+		Data: map[string]string{ServiceKey: "nginx", ReleaseLabel: releaseName},
+	})
+	api.add("secrets", &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "binding",
+			Namespace: "minibroker",
+			Labels:    map[string]string{InstanceLabel: "instance"},
+		},
+		Data: map[string][]byte{BindingParamsKey: []byte("{}")},
+	})
+
+	if _, err := c.Deprovision("instance", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := releases.GetRelease(releaseName); errors.Cause(err) != minibrokerhelm.ErrReleaseNotFound {
+		t.Errorf("expected release %s to be deleted, got %v", releaseName, err)
+	}
+	if api.get("configmaps", "minibroker", "instance") != nil {
+		t.Errorf("expected the instance configmap to be deleted")
+	}
+	if api.get("secrets", "minibroker", "binding") != nil {
+		t.Errorf("expected the binding of the instance to be deleted")
+	}
+	if _, err := c.Deprovision("instance", false); !isHTTPStatus(err, http.StatusGone) {
+		t.Errorf("deprovisioning again: expected a 410, got %v", err)
+	}
+}
+
+func TestDeprovisionFailedProvision(t *testing.T) {
+	api, coreClient := newFakeAPIServer(t)
+	defer api.close()
+	nginx := &chart.Chart{Metadata: &chart.Metadata{Name: "nginx", Version: "1.0.0", AppVersion: "1.19"}}
+	helm, cleanup := newTestHelmClient(t, nginx)
+	defer cleanup()
+	releases := minibrokerhelm.NewFakeReleaseManager()
+	namespaces, _ := newNamespaceGuard(NamespacePolicy{})
+	c := &Client{
+		coreClient: coreClient,
+		namespace:  "minibroker",
+		helm:       helm,
+		releases:   releases,
+		catalog:    &Catalog{},
+		schemas:    newSchemaCache(),
+		plans:      &planIndex{},
+		providers:  map[string]Provider{},
+		namespaces: namespaces,
+	}
+	c.plans.set(map[string]planChart{
+		planKey("nginx", "nginx-1-19"): {chart: "nginx", chartVersion: "1.0.0", appVersion: "1.19"},
+	})
+
+	// The release was never installed
+	releases.Err = errors.New("tiller is down")
+	if _, err := c.Provision("failed", "nginx", "nginx-1-19", "apps", false, false, nil, nil); err == nil {
+		t.Fatal("expected the provision to fail")
+	}
+	releases.Err = nil
+	if _, err := c.Deprovision("failed", false); err != nil {
+		t.Fatal(err)
+	}
+	if api.get("configmaps", "minibroker", "failed") != nil {
+		t.Errorf("expected the configmap of the failed instance to be deleted")
+	}
+
+	// The release was installed but not recorded
+	api.add("configmaps", &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "leaked",
+			Namespace: "minibroker",
+			Labels:    map[string]string{ServiceKey: "nginx"},
+		},
+		Data: map[string]string{ServiceKey: "nginx", OperationStateKey: string(osb.StateFailed)},
+	})
+	releases.InstallRelease(nginx, releaseNameForInstance("leaked"), "apps", nil, false)
+	operation, err := c.Deprovision("leaked", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := osb.OperationKey(operation)
+	for i := 0; i < 100 && api.get("configmaps", "minibroker", "leaked") != nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := c.LastOperationState("leaked", &key); !isHTTPStatus(err, http.StatusGone) {
+		t.Errorf("expected the leaked instance to be deleted, got %v", err)
+	}
+	if _, err := releases.GetRelease(releaseNameForInstance("leaked")); errors.Cause(err) != minibrokerhelm.ErrReleaseNotFound {
+		t.Errorf("expected the leaked release to be deleted, got %v", err)
+	}
+}
+
+// newTestHelmClient returns a helm client serving the given charts from a
+// local repository, and a function removing it.
+func newTestHelmClient(t *testing.T, charts ...*chart.Chart) (*minibrokerhelm.Client, func()) {
+	dir, err := ioutil.TempDir("", "minibroker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := repo.NewIndexFile()
+	for _, ch := range charts {
+		archive, err := chartutil.Save(ch, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.Add(ch.Metadata, filepath.Base(archive), "file://"+dir, "")
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	if err := os.MkdirAll(filepath.Join(cacheDir, "indexes"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.WriteFile(filepath.Join(cacheDir, "indexes", "local-index.yaml"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := minibrokerhelm.NewClient([]minibrokerhelm.Repository{{Name: "local", URL: "file://" + dir}}, minibrokerhelm.CacheOptions{Dir: cacheDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+// waitForOperation polls the last operation of an instance until it is no
+// longer in progress.
+func waitForOperation(t *testing.T, c *Client, instanceID, operation string) *osb.LastOperationResponse {
+	key := osb.OperationKey(operation)
+	for i := 0; i < 100; i++ {
+		response, err := c.LastOperationState(instanceID, &key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.State != osb.StateInProgress {
+			return response
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("operation %s of instance %s is still in progress", operation, instanceID)
+	return nil
+}
+
+func TestUpdate(t *testing.T) {
+	api, coreClient := newFakeAPIServer(t)
+	defer api.close()
+	nginx := func(version, appVersion string) *chart.Chart {
+		return &chart.Chart{Metadata: &chart.Metadata{Name: "nginx", Version: version, AppVersion: appVersion}}
+	}
+	helm, cleanup := newTestHelmClient(t, nginx("1.0.0", "1.19"), nginx("1.1.0", "1.20"))
+	defer cleanup()
+	releases := minibrokerhelm.NewFakeReleaseManager()
+	c := &Client{
+		coreClient: coreClient,
+		namespace:  "minibroker",
+		helm:       helm,
+		releases:   releases,
+		catalog:    &Catalog{},
+		schemas:    newSchemaCache(),
+		plans:      &planIndex{},
+		providers:  map[string]Provider{},
+	}
+	c.plans.set(map[string]planChart{
+		planKey("nginx", "nginx-1-19"): {chart: "nginx", chartVersion: "1.0.0", appVersion: "1.19"},
+		planKey("nginx", "nginx-1-20"): {chart: "nginx", chartVersion: "1.1.0", appVersion: "1.20"},
+	})
+
+	releaseName := releaseNameForInstance("instance")
+	releases.InstallRelease(nginx("1.0.0", "1.19"), releaseName, "apps", []byte("replicas: 1\n"), false)
+	api.add("configmaps", &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "instance",
+			Namespace: "minibroker",
+			Labels:    map[string]string{ServiceKey: "nginx", PlanKey: "nginx-1-19"},
+		},
+		Data: map[string]string{
+			ServiceKey:         "nginx",
+			PlanKey:            "nginx-1-19",
+			ProvisionParamsKey: `{"replicas":1}`,
+			ChartVersionKey:    "1.0.0",
+			ReleaseLabel:       releaseName,
+		},
+	})
+
+	// Synchronous updates of the parameters keep the plan
+	if _, err := c.Update("instance", "nginx", nil, false, map[string]interface{}{"image": "nginx"}); err != nil {
+		t.Fatal(err)
+	}
+	rel, _ := releases.GetRelease(releaseName)
+	if values := rel.GetConfig().GetRaw(); values != "image: nginx\nreplicas: 1\n" {
+		t.Errorf("sync update: expected the merged parameters, actual %q", values)
+	}
+	config := api.get("configmaps", "minibroker", "instance").(*corev1.ConfigMap)
+	if params := config.Data[ProvisionParamsKey]; params != `{"image":"nginx","replicas":1}` {
+		t.Errorf("sync update: expected the merged parameters to be recorded, actual %s", params)
+	}
+
+	// Asynchronous updates change the plan once the release is upgraded
+	planID := "nginx-1-20"
+	operation, err := c.Update("instance", "nginx", &planID, true, map[string]interface{}{"replicas": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(operation, OperationPrefixUpdate) {
+		t.Errorf("async update: expected an update operation, actual %q", operation)
+	}
+	if response := waitForOperation(t, c, "instance", operation); response.State != osb.StateSucceeded {
+		t.Fatalf("async update: expected the operation to succeed, actual %s (%s)", response.State, *response.Description)
+	}
+	rel, _ = releases.GetRelease(releaseName)
+	if version := rel.GetChart().GetMetadata().GetVersion(); version != "1.1.0" {
+		t.Errorf("async update: expected chart version 1.1.0, actual %s", version)
+	}
+	config = api.get("configmaps", "minibroker", "instance").(*corev1.ConfigMap)
+	if config.Labels[PlanKey] != planID || config.Data[ChartVersionKey] != "1.1.0" || config.Data[UpdatePlanKey] != "" {
+		t.Errorf("async update: expected plan %s with chart version 1.1.0, actual %v", planID, config.Data)
+	}
+
+	other := osb.OperationKey(OperationPrefixUpdate + "other")
+	if _, err := c.LastOperationState("instance", &other); !isHTTPStatus(err, http.StatusBadRequest) {
+		t.Errorf("expected a 400 for another operation, got %v", err)
+	}
+}
+
+func TestUpdateInvalidParameters(t *testing.T) {
+	api, coreClient := newFakeAPIServer(t)
+	defer api.close()
+	nginx := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "nginx", Version: "1.0.0", AppVersion: "1.19"},
+		Files: []*any.Any{{
+			TypeUrl: valuesSchemaFile,
+			Value:   []byte(`{"properties": {"replicas": {"type": "integer"}}}`),
+		}},
+	}
+	helm, cleanup := newTestHelmClient(t, nginx)
+	defer cleanup()
+	releases := minibrokerhelm.NewFakeReleaseManager()
+	c := &Client{
+		coreClient: coreClient,
+		namespace:  "minibroker",
+		helm:       helm,
+		releases:   releases,
+		catalog:    &Catalog{},
+		schemas:    newSchemaCache(),
+		plans:      &planIndex{},
+		providers:  map[string]Provider{},
+	}
+	c.plans.set(map[string]planChart{
+		planKey("nginx", "nginx-1-19"): {chart: "nginx", chartVersion: "1.0.0", appVersion: "1.19"},
+	})
+
+	releaseName := releaseNameForInstance("instance")
+	releases.InstallRelease(nginx, releaseName, "apps", []byte("replicas: 1\n"), false)
+	api.add("configmaps", &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "instance",
+			Namespace: "minibroker",
+			Labels:    map[string]string{ServiceKey: "nginx", PlanKey: "nginx-1-19"},
+		},
+		Data: map[string]string{
+			ServiceKey:         "nginx",
+			PlanKey:            "nginx-1-19",
+			ProvisionParamsKey: `{"replicas":1}`,
+			ChartVersionKey:    "1.0.0",
+			ReleaseLabel:       releaseName,
+		},
+	})
+	params := map[string]interface{}{"replicas": "two"}
+
+	// Until the chart is downloaded, its schema is checked by the operation
+	operation, err := c.Update("instance", "nginx", nil, true, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := waitForOperation(t, c, "instance", operation)
+	if response.State != osb.StateFailed {
+		t.Fatalf("expected the operation to fail, actual %s", response.State)
+	}
+	if !strings.Contains(*response.Description, "replicas: expected integer, got string") {
+		t.Errorf("expected the description to list the invalid parameters, actual %q", *response.Description)
+	}
+
+	// Then the catalog advertises it and the request is rejected
+	schemas := c.catalogSchemas("nginx", "1.0.0").ServiceInstances.Create.Parameters.(map[string]interface{})
+	if replicas := schemas["properties"].(map[string]interface{})["replicas"]; !reflect.DeepEqual(replicas, map[string]interface{}{"type": "integer"}) {
+		t.Errorf("expected the catalog to advertise the schema of the chart, actual %v", schemas)
+	}
+	if _, err := c.Update("instance", "nginx", nil, true, params); !isHTTPStatus(err, http.StatusBadRequest) {
+		t.Errorf("expected a 400 once the schema is known, got %v", err)
+	}
+	rel, _ := releases.GetRelease(releaseName)
+	if values := rel.GetConfig().GetRaw(); values != "replicas: 1\n" {
+		t.Errorf("expected the release to be left alone, actual values %q", values)
+	}
+}
+
+func isHTTPStatus(err error, code int) bool {
+	httpErr, ok := osb.IsHTTPError(err)
+	return ok && httpErr.StatusCode == code
+}
+
+func TestReleaseNameForInstance(t *testing.T) {
+	name := releaseNameForInstance("c3bb5c59-4a3e-4cb4-8bd0-8ac2ecc2e8fb")
+	if len(name) > 53 {
+		t.Errorf("releaseNameForInstance: %q is longer than 53 characters", name)
+	}
+	if again := releaseNameForInstance("c3bb5c59-4a3e-4cb4-8bd0-8ac2ecc2e8fb"); again != name {
+		t.Errorf("releaseNameForInstance: expected %q, actual %q", name, again)
+	}
+}
+
+func TestCatalogService(t *testing.T) {
+	service := CatalogService{
+		Name:     "database",
+		Tags:     []string{"sql"},
+		Versions: []string{"5.7.*", "8.0.11"},
+		Plans: map[string]CatalogPlan{
+			"5.7.14": {Name: "small"},
+		},
+	}
+
+	testcases := map[string]bool{
+		"5.7.14": true,
+		"8.0.11": true,
+		"8.0.12": false,
+		"5.6.0":  false,
+	}
+	for appVersion, want := range testcases {
+		if got := service.offers(appVersion); got != want {
+			t.Errorf("offers(%q) = %v, want %v", appVersion, got, want)
+		}
+	}
+
+	svc := osb.Service{ID: "mysql", Name: "mysql", Description: "Helm Chart for mysql"}
+	service.apply(&svc)
+	if svc.ID != "mysql" || svc.Name != "database" || svc.Description != "Helm Chart for mysql" || !reflect.DeepEqual(svc.Tags, []string{"sql"}) {
+		t.Errorf("unexpected service %+v", svc)
+	}
+
+	plan := osb.Plan{ID: "mysql-5-7-14", Name: "5-7-14"}
+	service.applyPlan("5.7.14", &plan)
+	if plan.ID != "mysql-5-7-14" || plan.Name != "small" {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+}
+
+func TestLoadCatalogTiers(t *testing.T) {
+	testcases := map[string]bool{
+		"small, large":     true,
+		"small, small":     false,
+		"small, Small":     false,
+		"x.large, x-large": false,
+		"4gb, 2-replicas":  true,
+	}
+	for names, valid := range testcases {
+		var tiers []string
+		for _, name := range strings.Split(names, ", ") {
+			tiers = append(tiers, fmt.Sprintf("{name: %q, version: 5.7.14}", name))
+		}
+		f, err := ioutil.TempFile("", "catalog")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		fmt.Fprintf(f, "services: {mysql: {tiers: [%s]}}\n", strings.Join(tiers, ", "))
+		f.Close()
+
+		if _, err := LoadCatalog(f.Name()); valid != (err == nil) {
+			t.Errorf("tiers %s: expected valid %v, got error %v", names, valid, err)
+		}
+	}
+}
+
+func TestResolveTierPlan(t *testing.T) {
+	c := &Client{
+		helm: &minibrokerhelm.Client{},
+		catalog: &Catalog{
+			Services: map[string]CatalogService{
+				"mysql": {
+					Tiers: []CatalogTier{{
+						Name:    "small",
+						Version: "5.7.14",
+						Values: map[string]interface{}{
+							"persistence": map[string]interface{}{"size": "8Gi"},
+							"replicas":    1,
+						},
+					}},
+				},
+			},
+		},
+		schemas: newSchemaCache(),
+		plans:   &planIndex{},
+	}
+	_, plans := c.catalogServices(map[string]repo.ChartVersions{
+		"mysql": {testChartVersion("mysql", "0.10.2", "5.7.14")},
+	})
+	c.plans.set(plans)
+
+	plan, err := c.resolvePlan("mysql", "mysql-small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.appVersion != "5.7.14" || plan.chartVersion != "0.10.2" {
+		t.Errorf("expected the chart of the tier app version, got %+v", plan)
+	}
+	values, err := releaseValues(plan, map[string]interface{}{"replicas": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "persistence:\n  size: 8Gi\nreplicas: 2\n"
+	if string(values) != expected {
+		t.Errorf("expected values %q, got %q", expected, values)
+	}
+
+	plan, err = c.resolvePlan("mysql", "mysql-5-7-14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.appVersion != "5.7.14" || plan.values != nil {
+		t.Errorf("expected the generated plan, got %+v", plan)
+	}
+}
+
+func TestTierPlanCollision(t *testing.T) {
+	tiers := CatalogService{
+		Tiers: []CatalogTier{
+			{Name: "5.7.14", Version: "5.7.14", Values: map[string]interface{}{"replicas": 2}},
+			{Name: "4gb", Version: "5.7.14", Values: map[string]interface{}{"replicas": 3}},
+		},
+	}
+	appVersions := map[string]*repo.ChartVersion{
+		"5.7.14": testChartVersion("mysql", "0.10.2", "5.7.14"),
+	}
+	index := map[string]planChart{
+		planKey("mysql", "mysql-5-7-14"): {chart: "mysql", chartVersion: "0.10.2", appVersion: "5.7.14"},
+	}
+	schemas := func(string) *osb.ParameterSchemas { return nil }
+
+	plans := tiers.tierPlans("mysql", appVersions, schemas, index)
+	if len(plans) != 1 || plans[0].ID != "mysql-4gb" {
+		t.Fatalf("expected only the plan of the 4gb tier, got %+v", plans)
+	}
+	if plan := index[planKey("mysql", "mysql-5-7-14")]; plan.values != nil {
+		t.Errorf("expected the plan of the app version to be kept, got %+v", plan)
+	}
+	if plan := index[planKey("mysql", "mysql-4gb")]; plan.chartVersion != "0.10.2" || plan.values == nil {
+		t.Errorf("unexpected plan of the 4gb tier %+v", plan)
+	}
+}
+
+func TestResolvePlan(t *testing.T) {
+	c := &Client{
+		helm:    &minibrokerhelm.Client{},
+		catalog: &Catalog{},
+		schemas: newSchemaCache(),
+		plans:   &planIndex{},
+	}
+	services, plans := c.catalogServices(map[string]repo.ChartVersions{
+		"mongodb": {
+			testChartVersion("mongodb", "5.3.0", "4.0.10-debian"),
+			testChartVersion("mongodb", "5.3.1", "4.0.10-debian"),
+			testChartVersion("mongodb", "5.2.0", "4.0.10.debian"),
+			testChartVersion("mongodb", "4.0.0", "3.6.5"),
+		},
+		"mirror.mongodb": {testChartVersion("mongodb", "5.3.0", "4.0.10-debian")},
+	})
+	c.plans.set(plans)
+	if len(services) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(services))
+	}
+
+	testcases := []struct {
+		serviceID    string
+		planID       string
+		chart        string
+		chartVersion string
+		appVersion   string
+	}{
+		{"mongodb", "mongodb-4-0-10-debian", "mongodb", "5.3.1", "4.0.10-debian"},
+		{"mongodb", "mongodb-3-6-5", "mongodb", "4.0.0", "3.6.5"},
+		{"mirror.mongodb", "mirror-mongodb-4-0-10-debian", "mirror.mongodb", "5.3.0", "4.0.10-debian"},
+	}
+	for _, tc := range testcases {
+		plan, err := c.resolvePlan(tc.serviceID, tc.planID)
+		if err != nil {
+			t.Errorf("resolvePlan(%q, %q): %v", tc.serviceID, tc.planID, err)
+			continue
+		}
+		if plan.chart != tc.chart || plan.chartVersion != tc.chartVersion || plan.appVersion != tc.appVersion {
+			t.Errorf("resolvePlan(%q, %q) = %+v, want %s-%s (%s)", tc.serviceID, tc.planID, plan, tc.chart, tc.chartVersion, tc.appVersion)
+		}
+	}
+
+	_, err := c.resolvePlan("mongodb", "mongodb-9-9")
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); !ok || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a 400 error for an unknown plan, got %v", err)
+	}
+}
+
+func TestInstalledPlan(t *testing.T) {
+	releases := minibrokerhelm.NewFakeReleaseManager()
+	c := &Client{
+		helm:     &minibrokerhelm.Client{},
+		catalog:  &Catalog{},
+		releases: releases,
+		plans:    &planIndex{},
+	}
+	c.plans.set(map[string]planChart{})
+	mysql := &chart.Chart{Metadata: &chart.Metadata{Name: "mysql", Version: "0.10.2", AppVersion: "5.7.14"}}
+	releases.InstallRelease(mysql, "dusty-mysql", "apps", []byte("persistence:\n  size: 8Gi\n"), false)
+
+	// A tier dropped from the catalog
+	_, err := c.resolvePlan("mysql", "mysql-small")
+	if !isUnknownPlan(err) {
+		t.Fatalf("expected an unknown plan, got %v", err)
+	}
+	plan, err := c.installedPlan("mysql", "dusty-mysql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.chart != "mysql" || plan.chartVersion != "0.10.2" || plan.appVersion != "5.7.14" {
+		t.Errorf("expected the chart of the release, got %+v", plan)
+	}
+	values, err := releaseValues(plan, map[string]interface{}{"replicas": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "persistence:\n  size: 8Gi\nreplicas: 2\n"; string(values) != expected {
+		t.Errorf("expected the values of the release to be kept, got %q", values)
+	}
+}
+
+func testChartVersion(name, version, appVersion string) *repo.ChartVersion {
+	return &repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: name, Version: version, AppVersion: appVersion},
+	}
+}
+
+func TestValidateParameters(t *testing.T) {
+	c := &Client{helm: &minibrokerhelm.Client{}, providers: map[string]Provider{"mysql": MySQLProvider{}}}
+	schema := c.buildSchemas("mysql", nil).provision
+	// Only the parameters of the provider are enforced until the chart is
+	// downloaded, its inferred schema never is
+	inferred := &chart.Chart{
+		Values: &chart.Config{Raw: "replicas: 1\npersistence:\n  enabled: true\n  size: 8Gi\n"},
+	}
+	declared := &chart.Chart{
+		Files: []*any.Any{{
+			TypeUrl: valuesSchemaFile,
+			Value:   []byte(`{"properties": {"persistence": {"properties": {"enabled": {"type": "boolean"}}}}}`),
+		}},
+	}
+
+	testcases := []struct {
+		params map[string]interface{}
+		valid  bool
+	}{
+		{nil, true},
+		{map[string]interface{}{"replicas": 2.0, "mysqlUser": "user", "extra": true}, true},
+		{map[string]interface{}{"replicas": "two"}, true},
+		{map[string]interface{}{"mysqlUser": 1.0}, false},
+		{map[string]interface{}{"persistence": map[string]interface{}{"enabled": "yes"}}, false},
+	}
+
+	for _, tc := range testcases {
+		err := validateParameters(schema, tc.params)
+		if err == nil {
+			if inferredErr := c.buildSchemas("mysql", inferred).validate(tc.params); inferredErr != nil {
+				t.Errorf("expected %v to be valid against an inferred schema, got %v", tc.params, inferredErr)
+			}
+			err = c.buildSchemas("mysql", declared).validate(tc.params)
+		}
+		if tc.valid && err != nil {
+			t.Errorf("expected %v to be valid, got %v", tc.params, err)
+		}
+		if !tc.valid {
+			statusErr, ok := err.(osb.HTTPStatusCodeError)
+			if !ok || statusErr.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected a 400 error for %v, got %v", tc.params, err)
+			}
+		}
+	}
+
+	strict := map[string]interface{}{
+		"type":                 "object",
+		"required":             []interface{}{"size"},
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"size": map[string]interface{}{"type": "string", "enum": []interface{}{"small", "large"}},
+		},
+	}
+	if err := validateParameters(strict, map[string]interface{}{"size": "small"}); err != nil {
+		t.Errorf("expected a valid size, got %v", err)
+	}
+	if err := validateParameters(strict, map[string]interface{}{"size": "huge", "other": 1.0}); err == nil {
+		t.Error("expected an unknown size and parameter to be rejected")
+	}
+	if err := validateParameters(strict, nil); err == nil {
+		t.Error("expected a missing size to be rejected")
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	c := &Client{
+		helm: &minibrokerhelm.Client{},
+		catalog: &Catalog{
+			Parameters: ParameterPolicy{
+				Forbidden: []string{"image", "securityContext"},
+			},
+			Services: map[string]CatalogService{
+				"mysql": {
+					Parameters: ParameterPolicy{
+						Allowed: []string{"mysqlDatabase", "mysqlUser", "persistence.size", "replicas"},
+						Limits: map[string]ParameterLimit{
+							"persistence.size": {Max: "20Gi"},
+							"replicas":         {Min: "1", Max: "3"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testcases := []struct {
+		serviceID string
+		params    map[string]interface{}
+		allowed   bool
+	}{
+		{"mysql", nil, true},
+		{"mysql", map[string]interface{}{"mysqlUser": "user", "replicas": 2.0}, true},
+		{"mysql", map[string]interface{}{"persistence": map[string]interface{}{"size": "8Gi"}}, true},
+		{"mysql", map[string]interface{}{"persistence": map[string]interface{}{"size": "1Ti"}}, false},
+		{"mysql", map[string]interface{}{"persistence": map[string]interface{}{"storageClass": "fast"}}, false},
+		{"mysql", map[string]interface{}{"replicas": 10.0}, false},
+		{"mysql", map[string]interface{}{"replicas": 1e17}, false},
+		{"mysql", map[string]interface{}{"persistence": map[string]interface{}{"size": 1e17}}, false},
+		{"mysql", map[string]interface{}{"replicas": 1e300}, false},
+		{"mysql", map[string]interface{}{"replicas": -1e17}, false},
+		{"mysql", map[string]interface{}{"replicas": math.Inf(1)}, false},
+		{"mysql", map[string]interface{}{"replicas": 2.5}, true},
+		{"mysql", map[string]interface{}{"replicas": "many"}, false},
+		{"redis", map[string]interface{}{"cluster": map[string]interface{}{"enabled": true}}, true},
+		{"redis", map[string]interface{}{"image": "evil"}, false},
+		{"redis", map[string]interface{}{"securityContext": map[string]interface{}{"runAsUser": 0.0}}, false},
+	}
+
+	for _, tc := range testcases {
+		err := c.checkPolicy(tc.serviceID, tc.params)
+		if tc.allowed && err != nil {
+			t.Errorf("expected %v to be allowed for %s, got %v", tc.params, tc.serviceID, err)
+		}
+		if !tc.allowed {
+			statusErr, ok := err.(osb.HTTPStatusCodeError)
+			if !ok || statusErr.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected a 400 error for %v on %s, got %v", tc.params, tc.serviceID, err)
+			}
+		}
+	}
+}
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	testcases := []struct {
+		identity *osb.OriginatingIdentity
+		expected *OriginatingIdentity
+		valid    bool
+	}{
+		{nil, nil, true},
+		{
+			&osb.OriginatingIdentity{Platform: "kubernetes", Value: `{"username": "alice", "uid": "1234", "groups": ["admins"]}`},
+			&OriginatingIdentity{Platform: "kubernetes", User: "alice", UID: "1234", Groups: []string{"admins"}},
+			true,
+		},
+		{
+			&osb.OriginatingIdentity{Platform: "cloudfoundry", Value: `{"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}`},
+			&OriginatingIdentity{Platform: "cloudfoundry", User: "683ea748-3092-4ff4-b656-39cacc4d5360"},
+			true,
+		},
+		{
+			&osb.OriginatingIdentity{Platform: "other", Value: `{"name": "bob"}`},
+			&OriginatingIdentity{Platform: "other"},
+			true,
+		},
+		{&osb.OriginatingIdentity{Platform: "kubernetes", Value: `{"uid": "1234"}`}, nil, false},
+		{&osb.OriginatingIdentity{Platform: "cloudfoundry", Value: `not json`}, nil, false},
+	}
+
+	for _, tc := range testcases {
+		actual, err := ParseOriginatingIdentity(tc.identity)
+		if !tc.valid {
+			statusErr, ok := err.(osb.HTTPStatusCodeError)
+			if !ok || statusErr.StatusCode != http.StatusBadRequest {
+				t.Errorf("ParseOriginatingIdentity(%+v): expected a 400 error, got %v", tc.identity, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseOriginatingIdentity(%+v): unexpected error %v", tc.identity, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("ParseOriginatingIdentity(%+v): expected %+v, actual %+v", tc.identity, tc.expected, actual)
+		}
+	}
+}
+
+func TestNamespacePolicy(t *testing.T) {
+	g, err := newNamespaceGuard(NamespacePolicy{
+		Allowed:        []string{"default"},
+		AllowedPattern: "team-[a-z]+",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		namespace string
+		allowed   bool
+	}{
+		{"default", true},
+		{"team-a", true},
+		{"team-a-prod", false},
+		{"kube-system", false},
+		{"my-team-a", false},
+	}
+	for _, tc := range testcases {
+		if allowed := g.allows(tc.namespace); allowed != tc.allowed {
+			t.Errorf("allows(%s): expected %t, actual %t", tc.namespace, tc.allowed, allowed)
+		}
+	}
+
+	if _, err := newNamespaceGuard(NamespacePolicy{AllowedPattern: "team-("}); err == nil {
+		t.Errorf("expected an invalid pattern to be rejected")
+	}
+
+	// Namespaces are checked before anything else, e.g. the plan
+	c := &Client{helm: &minibrokerhelm.Client{}, namespaces: g, plans: &planIndex{}}
+	c.plans.set(map[string]planChart{})
+	_, err = c.Provision("1", "mysql", "mysql-5-7-14", "kube-system", false, true, nil, nil)
+	if !isHTTPStatus(err, http.StatusForbidden) {
+		t.Errorf("Provision(kube-system): expected a 403, got %v", err)
+	}
+}
+
+func TestEnsureNamespace(t *testing.T) {
+	api, coreClient := newFakeAPIServer(t)
+	defer api.close()
+	c := &Client{coreClient: coreClient}
+
+	if err := c.ensureNamespace("cf-space"); err != nil {
+		t.Fatal(err)
+	}
+	created, ok := api.get("namespaces", "", "cf-space").(*corev1.Namespace)
+	if !ok || created.Labels[HeritageLabel] != "minibroker" {
+		t.Errorf("expected namespace cf-space to be created, got %v", created)
+	}
+	if err := c.ensureNamespace("cf-space"); err != nil {
+		t.Errorf("expected an existing namespace to be kept, got %v", err)
+	}
+
+	api.forbid("namespaces")
+	if err := c.ensureNamespace("cf-other"); err == nil {
+		t.Error("expected the namespaces minibroker may not read to be reported")
+	}
+}
+
+func TestCountInstances(t *testing.T) {
+	instance := func(namespace, serviceID string, labeled bool) corev1.ConfigMap {
+		config := corev1.ConfigMap{
+			Data: map[string]string{ServiceKey: serviceID},
+		}
+		config.Labels = map[string]string{ServiceKey: serviceID}
+		if labeled {
+			config.Labels[ReleaseNamespaceKey] = namespace
+		} else {
+			config.Data[ReleaseNamespaceKey] = namespace
+		}
+		return config
+	}
+	configs := []corev1.ConfigMap{
+		instance("team-a", "mysql", true),
+		instance("team-a", "mysql", false),
+		instance("team-a", "redis", true),
+		instance("team-b", "mysql", true),
+	}
+
+	instances, serviceInstances := countInstances(configs, "team-a", "mysql")
+	if instances != 3 || serviceInstances != 2 {
+		t.Errorf("countInstances(team-a, mysql): expected 3 and 2, actual %d and %d", instances, serviceInstances)
+	}
+	instances, serviceInstances = countInstances(configs, "team-c", "mysql")
+	if instances != 0 || serviceInstances != 0 {
+		t.Errorf("countInstances(team-c, mysql): expected 0 and 0, actual %d and %d", instances, serviceInstances)
+	}
+}
@@ -1,12 +1,21 @@
 package minibroker
 
 import (
+	"fmt"
+
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 )
 
 type MongodbProvider struct{}
 
+func (p MongodbProvider) Parameters() map[string]interface{} {
+	return map[string]interface{}{
+		"mongodbDatabase": stringParameter("Name of the database to create"),
+		"mongodbUsername": stringParameter("Name of the user to create; root is used when unset"),
+	}
+}
+
 func (p MongodbProvider) Bind(services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}) (*Credentials, error) {
 	service := services[0]
 	if len(service.Spec.Ports) == 0 {
@@ -54,3 +63,73 @@ func (p MongodbProvider) Bind(services []corev1.Service, params map[string]inter
 
 	return &creds, nil
 }
+
+func (p MongodbProvider) CreateUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user, password string) (*Credentials, error) {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return nil, err
+	}
+	rootPassword, ok := chartSecrets["mongodb-root-password"]
+	if !ok {
+		return nil, errors.Errorf("mongodb-root-password not found in secret keys")
+	}
+
+	database, role := creds.Database, "readWrite"
+	if database == "" {
+		database, role = "admin", "readWriteAnyDatabase"
+	}
+	script := fmt.Sprintf(
+		"var d = db.getSiblingDB(%s); if (!d.getUser(%s)) { d.createUser({user: %s, pwd: %s, roles: [{role: %s, db: %s}]}); }",
+		jsString(database), jsString(user), jsString(user), jsString(password), jsString(role), jsString(database))
+	_, err = runner.Run(mongoCommand(*creds), nil, mongoAuth(rootPassword.(string))+script)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create user %s", user)
+	}
+
+	creds.Username = user
+	creds.Password = password
+	creds.URI = buildURI(*creds)
+	return creds, nil
+}
+
+func (p MongodbProvider) DropUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user string) error {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return err
+	}
+	rootPassword, ok := chartSecrets["mongodb-root-password"]
+	if !ok {
+		return errors.Errorf("mongodb-root-password not found in secret keys")
+	}
+
+	database := creds.Database
+	if database == "" {
+		database = "admin"
+	}
+	script := fmt.Sprintf(
+		"var d = db.getSiblingDB(%s); if (d.getUser(%s)) { d.dropUser(%s); }",
+		jsString(database), jsString(user), jsString(user))
+	_, err = runner.Run(mongoCommand(*creds), nil, mongoAuth(rootPassword.(string))+script)
+	if err != nil {
+		return errors.Wrapf(err, "could not drop user %s", user)
+	}
+	return nil
+}
+
+// mongoCommand runs the command script, which authenticates itself as root
+// with mongoAuth so that the root password is kept out of the arguments.
+func mongoCommand(creds Credentials) []string {
+	return []string{
+		"mongo", "admin",
+		"--host", creds.Host,
+		"--port", fmt.Sprintf("%d", creds.Port),
+		"--quiet",
+		commandScriptPath,
+	}
+}
+
+// mongoAuth returns the statement authenticating a script as root, failing
+// it when the password is refused.
+func mongoAuth(rootPassword string) string {
+	return fmt.Sprintf("if (!db.getSiblingDB(\"admin\").auth(\"root\", %s)) { quit(1); } ", jsString(rootPassword))
+}
@@ -1,12 +1,22 @@
 package minibroker
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 )
 
 type MySQLProvider struct{}
 
+func (p MySQLProvider) Parameters() map[string]interface{} {
+	return map[string]interface{}{
+		"mysqlDatabase": stringParameter("Name of the database to create"),
+		"mysqlUser":     stringParameter("Name of the user to create; root is used when unset"),
+	}
+}
+
 func (p MySQLProvider) Bind(services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}) (*Credentials, error) {
 	service := services[0]
 	if len(service.Spec.Ports) == 0 {
@@ -54,3 +64,61 @@ func (p MySQLProvider) Bind(services []corev1.Service, params map[string]interfa
 
 	return &creds, nil
 }
+
+func (p MySQLProvider) CreateUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user, password string) (*Credentials, error) {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return nil, err
+	}
+	return createMySQLUser(runner, *creds, "mysql-root-password", user, password)
+}
+
+func (p MySQLProvider) DropUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user string) error {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return err
+	}
+	return dropMySQLUser(runner, *creds, "mysql-root-password", user)
+}
+
+// createMySQLUser creates a user through the root account of a MySQL
+// compatible server, granting it access to the credentials database (or to
+// all of them if no database was requested). The root password is read from
+// the rootPasswordKey of the chart secrets.
+func createMySQLUser(runner CommandRunner, creds Credentials, rootPasswordKey, user, password string) (*Credentials, error) {
+	grantOn := "*.*"
+	if creds.Database != "" {
+		grantOn = fmt.Sprintf("`%s`.*", strings.Replace(creds.Database, "`", "``", -1))
+	}
+	statements := fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY '%s'; GRANT ALL PRIVILEGES ON %s TO '%s'@'%%';",
+		user, password, grantOn, user)
+	_, err := runner.Run(mysqlCommand(creds), map[string]string{"MYSQL_PWD": rootPasswordKey}, statements)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create user %s", user)
+	}
+
+	creds.Username = user
+	creds.Password = password
+	creds.URI = buildURI(creds)
+	return &creds, nil
+}
+
+func dropMySQLUser(runner CommandRunner, creds Credentials, rootPasswordKey, user string) error {
+	statements := fmt.Sprintf("DROP USER IF EXISTS '%s'@'%%';", user)
+	_, err := runner.Run(mysqlCommand(creds), map[string]string{"MYSQL_PWD": rootPasswordKey}, statements)
+	if err != nil {
+		return errors.Wrapf(err, "could not drop user %s", user)
+	}
+	return nil
+}
+
+// mysqlCommand runs the statements of the command script as root.
+func mysqlCommand(creds Credentials) []string {
+	return []string{
+		"mysql",
+		"--host", creds.Host,
+		"--port", fmt.Sprintf("%d", creds.Port),
+		"--user", "root",
+		"--execute", "source " + commandScriptPath,
+	}
+}
@@ -0,0 +1,161 @@
+package minibroker
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NamespacePolicy restricts the namespaces instances are provisioned into,
+// and how many instances each of them holds.
+type NamespacePolicy struct {
+	// Allowed are the namespaces instances may be provisioned into. All
+	// namespaces are allowed when both Allowed and AllowedPattern are empty.
+	Allowed []string
+	// AllowedPattern is a regular expression matching whole namespace names
+	// instances may also be provisioned into, e.g. team-.*
+	AllowedPattern string
+	// MaxInstances limits the instances of each namespace. Unlimited when 0.
+	MaxInstances int
+	// MaxServiceInstances limits the instances of each service in each
+	// namespace. Unlimited when 0.
+	MaxServiceInstances int
+}
+
+// namespaceGuard enforces a namespace policy.
+type namespaceGuard struct {
+	policy  NamespacePolicy
+	pattern *regexp.Regexp
+
+	// provisioning is held from counting the instances of a namespace until
+	// a new one is recorded, so that concurrent provisions cannot exceed the
+	// quotas.
+	provisioning sync.Mutex
+}
+
+func newNamespaceGuard(policy NamespacePolicy) (*namespaceGuard, error) {
+	g := &namespaceGuard{policy: policy}
+	if policy.AllowedPattern != "" {
+		pattern, err := regexp.Compile("^(?:" + policy.AllowedPattern + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowed namespace pattern %q", policy.AllowedPattern)
+		}
+		g.pattern = pattern
+	}
+	if policy.MaxInstances < 0 || policy.MaxServiceInstances < 0 {
+		return nil, errors.New("namespace quotas cannot be negative")
+	}
+	return g, nil
+}
+
+// allows reports whether instances may be provisioned into a namespace.
+func (g *namespaceGuard) allows(namespace string) bool {
+	if len(g.policy.Allowed) == 0 && g.pattern == nil {
+		return true
+	}
+	for _, allowed := range g.policy.Allowed {
+		if namespace == allowed {
+			return true
+		}
+	}
+	return g.pattern != nil && g.pattern.MatchString(namespace)
+}
+
+func (g *namespaceGuard) hasQuotas() bool {
+	return g.policy.MaxInstances > 0 || g.policy.MaxServiceInstances > 0
+}
+
+// countInstances returns the number of instances in a namespace, and the
+// number of them of a service.
+func countInstances(configs []corev1.ConfigMap, namespace, serviceID string) (int, int) {
+	var instances, serviceInstances int
+	for _, config := range configs {
+		releaseNamespace, ok := config.Labels[ReleaseNamespaceKey]
+		if !ok {
+			// Instances provisioned before namespaces were labeled
+			releaseNamespace = config.Data[ReleaseNamespaceKey]
+		}
+		if releaseNamespace != namespace {
+			continue
+		}
+		instances++
+		if config.Data[ServiceKey] == serviceID {
+			serviceInstances++
+		}
+	}
+	return instances, serviceInstances
+}
+
+// checkNamespace rejects the namespaces instances may not be provisioned
+// into.
+func (c *Client) checkNamespace(namespace string) error {
+	if !c.namespaces.allows(namespace) {
+		return namespaceError(fmt.Sprintf("instances may not be provisioned into namespace %q", namespace))
+	}
+	return nil
+}
+
+// checkQuotas enforces the namespace quotas on a new instance of a service.
+// Every instance counts until it is deprovisioned, even when its provision
+// failed. The caller holds c.namespaces.provisioning.
+func (c *Client) checkQuotas(serviceID, namespace string) error {
+	if !c.namespaces.hasQuotas() {
+		return nil
+	}
+
+	configs, err := c.coreClient.CoreV1().ConfigMaps(c.namespace).List(metav1.ListOptions{
+		LabelSelector: ServiceKey,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not list the instances to check the namespace quotas")
+	}
+	instances, serviceInstances := countInstances(configs.Items, namespace, serviceID)
+
+	policy := c.namespaces.policy
+	if policy.MaxInstances > 0 && instances >= policy.MaxInstances {
+		return namespaceError(fmt.Sprintf("namespace %q already has %d instances, the maximum", namespace, instances))
+	}
+	if policy.MaxServiceInstances > 0 && serviceInstances >= policy.MaxServiceInstances {
+		return namespaceError(fmt.Sprintf("namespace %q already has %d instances of %s, the maximum", namespace, serviceInstances, serviceID))
+	}
+	return nil
+}
+
+// ensureNamespace creates the namespace a release is installed into when it
+// does not exist yet, e.g. the namespace of a Cloud Foundry space.
+func (c *Client) ensureNamespace(namespace string) error {
+	_, err := c.coreClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "could not check that namespace %s exists", namespace)
+	}
+
+	glog.Infof("Creating namespace %s", namespace)
+	_, err = c.coreClient.CoreV1().Namespaces().Create(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: map[string]string{HeritageLabel: "minibroker"},
+		},
+	})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "could not create namespace %s", namespace)
+	}
+	return nil
+}
+
+func namespaceError(msg string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusForbidden,
+		Description: &msg,
+	}
+}
@@ -0,0 +1,154 @@
+package minibroker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ParameterPolicy restricts the values users may set through the parameters
+// of an instance. Paths are dot-separated, e.g. persistence.size, and also
+// cover the values nested under them.
+type ParameterPolicy struct {
+	// Allowed are the only paths users may set. All paths are allowed when
+	// empty.
+	Allowed []string `json:"allowed,omitempty"`
+	// Forbidden are paths users may never set, even when allowed
+	Forbidden []string `json:"forbidden,omitempty"`
+	// Limits bound the numbers or quantities, e.g. 8Gi, set at a path
+	Limits map[string]ParameterLimit `json:"limits,omitempty"`
+}
+
+// ParameterLimit bounds a value. Either bound may be omitted.
+type ParameterLimit struct {
+	Min string `json:"min,omitempty"`
+	Max string `json:"max,omitempty"`
+}
+
+func (p ParameterPolicy) validate() error {
+	for path, limit := range p.Limits {
+		for _, bound := range []string{limit.Min, limit.Max} {
+			if bound == "" {
+				continue
+			}
+			if _, err := resource.ParseQuantity(bound); err != nil {
+				return errors.Wrapf(err, "invalid limit %q for %s", bound, path)
+			}
+		}
+	}
+	return nil
+}
+
+// check returns the violations of the policy by the given parameters.
+func (p ParameterPolicy) check(params map[string]interface{}) []string {
+	var violations []string
+	for name, value := range params {
+		violations = append(violations, p.checkValue(name, value)...)
+	}
+	return violations
+}
+
+func (p ParameterPolicy) checkValue(path string, value interface{}) []string {
+	if coversPath(p.Forbidden, path) {
+		return []string{fmt.Sprintf("%s: may not be set", path)}
+	}
+
+	var violations []string
+	if limit, ok := p.Limits[path]; ok {
+		if violation := limit.check(path, value); violation != "" {
+			violations = append(violations, violation)
+		}
+	}
+
+	if values, ok := value.(map[string]interface{}); ok && len(values) > 0 {
+		for name, nested := range values {
+			violations = append(violations, p.checkValue(path+"."+name, nested)...)
+		}
+		return violations
+	}
+
+	if len(p.Allowed) > 0 && !coversPath(p.Allowed, path) {
+		violations = append(violations, fmt.Sprintf("%s: may not be set", path))
+	}
+	return violations
+}
+
+func (l ParameterLimit) check(path string, value interface{}) string {
+	var quantity resource.Quantity
+	switch v := value.(type) {
+	case float64:
+		// Formatted rather than converted to milli-units, which overflows
+		var err error
+		quantity, err = resource.ParseQuantity(strconv.FormatFloat(v, 'f', -1, 64))
+		if err != nil {
+			return fmt.Sprintf("%s: expected a number or quantity, got %v", path, v)
+		}
+	case int:
+		quantity = *resource.NewQuantity(int64(v), resource.DecimalSI)
+	case string:
+		var err error
+		quantity, err = resource.ParseQuantity(v)
+		if err != nil {
+			return fmt.Sprintf("%s: expected a number or quantity, got %q", path, v)
+		}
+	default:
+		return fmt.Sprintf("%s: expected a number or quantity, got %s", path, jsonType(value))
+	}
+
+	if l.Min != "" {
+		if min := resource.MustParse(l.Min); quantity.Cmp(min) < 0 {
+			return fmt.Sprintf("%s: must be at least %s", path, l.Min)
+		}
+	}
+	if l.Max != "" {
+		if max := resource.MustParse(l.Max); quantity.Cmp(max) > 0 {
+			return fmt.Sprintf("%s: must be at most %s", path, l.Max)
+		}
+	}
+	return ""
+}
+
+// coversPath reports whether path is one of paths or nested under one of them.
+func coversPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicy enforces the parameter policies of the catalog on the
+// parameters of an instance of the given service.
+func (c *Client) checkPolicy(serviceID string, params map[string]interface{}) error {
+	violations := c.catalog.Parameters.check(params)
+	if service, ok := c.catalog.Services[serviceID]; ok {
+		violations = append(violations, service.Parameters.check(params)...)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Strings(violations)
+	msg := "parameters not allowed: " + strings.Join(dedupe(violations), "; ")
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &msg,
+	}
+}
+
+// dedupe removes the repeated entries of a sorted slice.
+func dedupe(sorted []string) []string {
+	out := sorted[:0]
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
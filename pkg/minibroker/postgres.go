@@ -1,12 +1,22 @@
 package minibroker
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 )
 
 type PostgresProvider struct{}
 
+func (p PostgresProvider) Parameters() map[string]interface{} {
+	return map[string]interface{}{
+		"postgresDatabase": stringParameter("Name of the database to create"),
+		"postgresUser":     stringParameter("Name of the user to create; postgres is used when unset"),
+	}
+}
+
 func (p PostgresProvider) Bind(services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}) (*Credentials, error) {
 	service := services[0]
 	if len(service.Spec.Ports) == 0 {
@@ -54,3 +64,79 @@ func (p PostgresProvider) Bind(services []corev1.Service, params map[string]inte
 
 	return &creds, nil
 }
+
+func (p PostgresProvider) CreateUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user, password string) (*Credentials, error) {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := fmt.Sprintf(
+		"DO $$ BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = '%s') THEN CREATE ROLE %s LOGIN PASSWORD '%s'; END IF; END $$;",
+		user, user, password)
+	if creds.Database != "" {
+		statements += fmt.Sprintf(" GRANT ALL PRIVILEGES ON DATABASE %s TO %s;", postgresIdentifier(creds.Database), user)
+	}
+	_, err = runner.Run(psqlCommand(*creds), map[string]string{"PGPASSWORD": postgresPasswordKey(chartSecrets)}, statements)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create user %s", user)
+	}
+
+	creds.Username = user
+	creds.Password = password
+	creds.URI = buildURI(*creds)
+	return creds, nil
+}
+
+func (p PostgresProvider) DropUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user string) error {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return err
+	}
+
+	statements := fmt.Sprintf(
+		"DO $$ BEGIN IF EXISTS (SELECT FROM pg_roles WHERE rolname = '%s') THEN REASSIGN OWNED BY %s TO %s; DROP OWNED BY %s; DROP ROLE %s; END IF; END $$;",
+		user, user, postgresSuperuser, user, user)
+	_, err = runner.Run(psqlCommand(*creds), map[string]string{"PGPASSWORD": postgresPasswordKey(chartSecrets)}, statements)
+	if err != nil {
+		return errors.Wrapf(err, "could not drop user %s", user)
+	}
+	return nil
+}
+
+// postgresSuperuser manages the users of bindings, as the user of the chart
+// is not allowed to create roles.
+const postgresSuperuser = "postgres"
+
+// postgresPasswordKey returns the key of the chart secrets holding the
+// password of postgresSuperuser. Chart versions 2.0+ only keep it apart from
+// postgresql-password when a postgresqlUsername is set.
+func postgresPasswordKey(chartSecrets map[string]interface{}) string {
+	for _, key := range []string{"postgresql-postgres-password", "postgresql-password"} {
+		if _, ok := chartSecrets[key]; ok {
+			return key
+		}
+	}
+	return "postgres-password"
+}
+
+// psqlCommand runs the statements of the command script as postgresSuperuser.
+func psqlCommand(creds Credentials) []string {
+	database := creds.Database
+	if database == "" {
+		database = "postgres"
+	}
+	return []string{
+		"psql",
+		"--host", creds.Host,
+		"--port", fmt.Sprintf("%d", creds.Port),
+		"--username", postgresSuperuser,
+		"--dbname", database,
+		"--set", "ON_ERROR_STOP=1",
+		"--file", commandScriptPath,
+	}
+}
+
+func postgresIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,353 @@
+package minibroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	minibrokerhelm "github.com/kubernetes-sigs/minibroker/pkg/helm"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+const (
+	recoverPollInterval = 5 * time.Second
+	recoverTimeout      = 10 * time.Minute
+)
+
+// OperationLocks are the locks the broker holds on instances and bindings
+// while it handles a request. Recovered operations hold them until they
+// complete, so that requests on the same instances and bindings are rejected
+// meanwhile.
+type OperationLocks interface {
+	// LockInstance locks an instance and returns the function unlocking it,
+	// or false if the instance is already locked.
+	LockInstance(instanceID string) (func(), bool)
+	// LockBinding locks a binding along with the instance it belongs to,
+	// which other bindings of the instance may lock as well.
+	LockBinding(instanceID, bindingID string) (func(), bool)
+}
+
+// RecoverOperations resumes the asynchronous operations that were in progress
+// when the broker last stopped. Operations that are still running in the
+// release backend are waited for in the background; the others are marked as
+// succeeded or failed according to the state of their release.
+func (c *Client) RecoverOperations(locks OperationLocks) error {
+	_, err := c.recoverOperations(locks)
+	return err
+}
+
+// recoverOperations starts recovering the operations in progress, and returns
+// the group of the goroutines recovering them.
+func (c *Client) recoverOperations(locks OperationLocks) (*sync.WaitGroup, error) {
+	var recovering sync.WaitGroup
+	recoverLocked := func(unlock func(), recover func()) {
+		recovering.Add(1)
+		go func() {
+			defer recovering.Done()
+			defer unlock()
+			recover()
+		}()
+	}
+
+	configMaps, err := c.coreClient.CoreV1().ConfigMaps(c.namespace).List(metav1.ListOptions{
+		LabelSelector: ServiceKey,
+	})
+	if err != nil {
+		return &recovering, errors.Wrap(err, "could not list instances")
+	}
+
+	for _, config := range configMaps.Items {
+		if config.Data[OperationStateKey] != string(osb.StateInProgress) {
+			continue
+		}
+		config := config
+		instanceID := config.Name
+		operationName := config.Data[OperationNameKey]
+		unlock, ok := locks.LockInstance(instanceID)
+		if !ok {
+			glog.Errorf("Could not recover operation %s of instance %q, which is locked", operationName, instanceID)
+			continue
+		}
+		glog.Infof("Recovering operation %s of instance %q", operationName, instanceID)
+
+		switch {
+		case strings.HasPrefix(operationName, OperationPrefixProvision):
+			recoverLocked(unlock, func() { c.recoverProvision(config) })
+		case strings.HasPrefix(operationName, OperationPrefixUpdate):
+			recoverLocked(unlock, func() { c.recoverUpdate(config) })
+		case strings.HasPrefix(operationName, OperationPrefixDeprovision):
+			recoverLocked(unlock, func() { c.recoverDeprovision(config) })
+		default:
+			c.failRecovery(instanceID, fmt.Sprintf("unknown operation %q", operationName))
+			unlock()
+		}
+	}
+
+	secrets, err := c.coreClient.CoreV1().Secrets(c.namespace).List(metav1.ListOptions{
+		LabelSelector: InstanceLabel,
+	})
+	if err != nil {
+		return &recovering, errors.Wrap(err, "could not list bindings")
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if string(secret.Data[OperationStateKey]) != string(osb.StateInProgress) {
+			continue
+		}
+		operationName := string(secret.Data[OperationNameKey])
+		unlock, ok := locks.LockBinding(secret.Labels[InstanceLabel], secret.Name)
+		if !ok {
+			glog.Errorf("Could not recover operation %s of binding %q, which is locked", operationName, secret.Name)
+			continue
+		}
+		glog.Infof("Recovering operation %s of binding %q", operationName, secret.Name)
+		recoverLocked(unlock, func() { c.recoverBinding(secret) })
+	}
+
+	return &recovering, nil
+}
+
+func (c *Client) recoverProvision(config corev1.ConfigMap) {
+	instanceID := config.Name
+	releaseName := releaseNameForInstance(instanceID)
+
+	rel, err := c.waitForRelease(releaseName, release.Status_PENDING_INSTALL)
+	if err != nil {
+		if isReleaseNotFound(err) {
+			c.failRecovery(instanceID, "the broker restarted before the release was installed")
+			return
+		}
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	if code := rel.GetInfo().GetStatus().GetCode(); code != release.Status_DEPLOYED {
+		c.failRecovery(instanceID, fmt.Sprintf("release %s is %s: %s", releaseName, code, rel.GetInfo().GetDescription()))
+		return
+	}
+
+	var provisionParams map[string]interface{}
+	if err := json.Unmarshal([]byte(config.Data[ProvisionParamsKey]), &provisionParams); err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	err = c.updateProvisioningState(releaseName, instanceID, rel.GetNamespace(), provisionParams)
+	if err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+
+	c.succeedRecovery(instanceID, fmt.Sprintf("service instance %q provisioned", instanceID))
+}
+
+func (c *Client) recoverUpdate(config corev1.ConfigMap) {
+	instanceID := config.Name
+	releaseName := config.Data[ReleaseLabel]
+
+	rel, err := c.waitForRelease(releaseName, release.Status_PENDING_UPGRADE)
+	if err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	if code := rel.GetInfo().GetStatus().GetCode(); code != release.Status_DEPLOYED {
+		c.failRecovery(instanceID, fmt.Sprintf("release %s is %s: %s", releaseName, code, rel.GetInfo().GetDescription()))
+		return
+	}
+
+	// The deployed release only reflects the update if it carries its values
+	var params map[string]interface{}
+	if err := json.Unmarshal([]byte(config.Data[UpdateParamsKey]), &params); err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	plan, err := c.resolvePlan(config.Data[ServiceKey], config.Data[UpdatePlanKey])
+	if isUnknownPlan(err) && config.Data[UpdatePlanKey] == config.Data[PlanKey] {
+		// Updates of the parameters of instances whose plan is no longer
+		// offered
+		plan, err = c.installedPlan(config.Data[ServiceKey], releaseName, config.Data[ChartVersionKey])
+	}
+	if err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	valuesYaml, err := releaseValues(plan, params)
+	if err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	upgraded, err := sameValues(rel.GetConfig().GetRaw(), string(valuesYaml))
+	if err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	if !upgraded {
+		c.failRecovery(instanceID, "the broker restarted before the release was upgraded")
+		return
+	}
+
+	err = c.updateUpdatingState(instanceID, config.Data[UpdatePlanKey], rel.GetChart().GetMetadata().GetVersion(), params)
+	if err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+
+	c.succeedRecovery(instanceID, fmt.Sprintf("service instance %q updated", instanceID))
+}
+
+func (c *Client) recoverDeprovision(config corev1.ConfigMap) {
+	instanceID := config.Name
+	releaseName := config.Data[ReleaseLabel]
+	if releaseName == "" {
+		// Failed provisions do not record the release they installed
+		releaseName = releaseNameForInstance(instanceID)
+	}
+	serviceID := config.Data[ServiceKey]
+
+	_, err := c.waitForRelease(releaseName, release.Status_DELETING)
+	if err != nil && !isReleaseNotFound(err) {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	if err == nil {
+		// The release was not purged yet; deleting it again is harmless
+		if err := c.deprovisionSynchronously(instanceID, serviceID, releaseName); err != nil {
+			c.failRecovery(instanceID, err.Error())
+		}
+		return
+	}
+
+	if err := c.deleteBindings(instanceID, serviceID); err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	err = c.coreClient.CoreV1().ConfigMaps(c.namespace).Delete(instanceID, &metav1.DeleteOptions{})
+	if err != nil {
+		c.failRecovery(instanceID, err.Error())
+		return
+	}
+	glog.Infof("Deprovision of %q is complete", instanceID)
+}
+
+func (c *Client) recoverBinding(secret *corev1.Secret) {
+	bindingID := secret.Name
+	instanceID := secret.Labels[InstanceLabel]
+	operationName := string(secret.Data[OperationNameKey])
+
+	serviceID, err := c.instanceServiceID(instanceID)
+	if err == nil && strings.HasPrefix(operationName, OperationPrefixUnbind) {
+		// Unbinding only drops the user and the secret, so it is safe to retry
+		err = c.unbindSynchronously(instanceID, serviceID, secret)
+		if err == nil {
+			return
+		}
+		glog.Errorf("Failed to recover unbinding %q: %s", bindingID, err)
+		c.failBindingRecovery(secret, fmt.Sprintf("binding %q failed to unbind", bindingID))
+		return
+	}
+
+	// Binding creates the user again if it exists, so it is safe to retry too
+	var resources *releaseResources
+	if err == nil {
+		var params map[string]interface{}
+		err = json.Unmarshal(secret.Data[BindingParamsKey], &params)
+		if err == nil {
+			resources, err = c.getReleaseResources(instanceID, params)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Failed to recover binding %q: %s", bindingID, err)
+		c.failBindingRecovery(secret, fmt.Sprintf("binding %q failed: %s", bindingID, err))
+		return
+	}
+	c.finishBinding(instanceID, serviceID, secret, resources)
+}
+
+func (c *Client) failBindingRecovery(secret *corev1.Secret, description string) {
+	_, err := c.updateBindingSecret(secret, map[string]interface{}{
+		OperationStateKey:       string(osb.StateFailed),
+		OperationDescriptionKey: description,
+	})
+	if err != nil {
+		glog.Errorf("Could not update operation state when recovering binding %q: %s", secret.Name, err)
+	}
+}
+
+func (c *Client) instanceServiceID(instanceID string) (string, error) {
+	config, err := c.getConfigMap(instanceID)
+	if err != nil {
+		return "", err
+	}
+	return config.Data[ServiceKey], nil
+}
+
+// waitForRelease returns the release once it has left the given pending
+// status.
+func (c *Client) waitForRelease(releaseName string, pending release.Status_Code) (*release.Release, error) {
+	var rel *release.Release
+	err := wait.PollImmediate(recoverPollInterval, recoverTimeout, func() (bool, error) {
+		var err error
+		rel, err = c.releases.GetRelease(releaseName)
+		if err != nil {
+			return false, err
+		}
+		return rel.GetInfo().GetStatus().GetCode() != pending, nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get status of release %s", releaseName)
+	}
+	return rel, nil
+}
+
+func (c *Client) succeedRecovery(instanceID, description string) {
+	glog.Infof("Recovered operation of instance %q", instanceID)
+	err := c.updateConfigMap(instanceID, map[string]interface{}{
+		OperationStateKey:       string(osb.StateSucceeded),
+		OperationDescriptionKey: description,
+	})
+	if err != nil {
+		glog.Errorf("Could not update operation state when recovering instance %q: %s", instanceID, err)
+	}
+}
+
+func (c *Client) failRecovery(instanceID, reason string) {
+	glog.Errorf("Failed to recover operation of instance %q: %s", instanceID, reason)
+	err := c.updateConfigMap(instanceID, map[string]interface{}{
+		OperationStateKey:       string(osb.StateFailed),
+		OperationDescriptionKey: fmt.Sprintf("service instance %q: %s", instanceID, reason),
+		UpdatePlanKey:           nil,
+		UpdateParamsKey:         nil,
+	})
+	if err != nil {
+		glog.Errorf("Could not update operation state when recovering instance %q: %s", instanceID, err)
+	}
+}
+
+// sameValues reports whether two values documents hold the same values,
+// however they are formatted.
+func sameValues(a, b string) (bool, error) {
+	aValues, err := chartutil.ReadValues([]byte(a))
+	if err != nil {
+		return false, errors.Wrap(err, "could not parse the values of the release")
+	}
+	bValues, err := chartutil.ReadValues([]byte(b))
+	if err != nil {
+		return false, errors.Wrap(err, "could not parse the values of the update")
+	}
+	return reflect.DeepEqual(aValues, bValues), nil
+}
+
+// isReleaseNotFound reports whether the release backend failed because the
+// release does not exist.
+func isReleaseNotFound(err error) bool {
+	return errors.Cause(err) == minibrokerhelm.ErrReleaseNotFound
+}
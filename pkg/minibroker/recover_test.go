@@ -0,0 +1,199 @@
+package minibroker
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	minibrokerhelm "github.com/kubernetes-sigs/minibroker/pkg/helm"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// fakeOperationLocks records the locks taken by recovery.
+type fakeOperationLocks struct {
+	mu     sync.Mutex
+	held   map[string]bool
+	locked []string
+}
+
+func (l *fakeOperationLocks) lock(key string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[key] {
+		return nil, false
+	}
+	l.held[key] = true
+	l.locked = append(l.locked, key)
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.held, key)
+	}, true
+}
+
+func (l *fakeOperationLocks) LockInstance(instanceID string) (func(), bool) {
+	return l.lock("instance/" + instanceID)
+}
+
+func (l *fakeOperationLocks) LockBinding(instanceID, bindingID string) (func(), bool) {
+	return l.lock("binding/" + bindingID)
+}
+
+func TestRecoverOperations(t *testing.T) {
+	api, coreClient := newFakeAPIServer(t)
+	defer api.close()
+	releases := minibrokerhelm.NewFakeReleaseManager()
+	c := &Client{
+		coreClient: coreClient,
+		namespace:  "minibroker",
+		helm:       &minibrokerhelm.Client{},
+		releases:   releases,
+		plans:      &planIndex{},
+		providers:  map[string]Provider{},
+	}
+	c.plans.set(map[string]planChart{
+		planKey("nginx", "large"): {chart: "stable/nginx", chartVersion: "1.0.0", values: map[string]interface{}{"replicas": 2}},
+	})
+	nginx := &chart.Chart{Metadata: &chart.Metadata{Name: "nginx", Version: "1.0.0"}}
+
+	instance := func(instanceID string, data map[string]string) {
+		data[ServiceKey] = "nginx"
+		data[ProvisionParamsKey] = "{}"
+		data[ReleaseNamespaceKey] = "apps"
+		api.add("configmaps", &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      instanceID,
+				Namespace: "minibroker",
+				Labels:    map[string]string{ServiceKey: "nginx", PlanKey: "small"},
+			},
+			Data: data,
+		})
+	}
+	binding := func(instanceID, bindingID string, data map[string][]byte) {
+		data[BindingParamsKey] = []byte("{}")
+		api.add("secrets", &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      bindingID,
+				Namespace: "minibroker",
+				Labels:    map[string]string{InstanceLabel: instanceID},
+			},
+			Data: data,
+		})
+	}
+
+	// Provisions complete when their release was deployed
+	instance("provisioned", map[string]string{
+		OperationStateKey: string(osb.StateInProgress),
+		OperationNameKey:  OperationPrefixProvision + "1",
+	})
+	releases.InstallRelease(nginx, releaseNameForInstance("provisioned"), "apps", nil, false)
+	instance("interrupted", map[string]string{
+		OperationStateKey: string(osb.StateInProgress),
+		OperationNameKey:  OperationPrefixProvision + "2",
+	})
+
+	// Updates complete when the release carries their values, however they
+	// were formatted
+	instance("updated", map[string]string{
+		OperationStateKey: string(osb.StateInProgress),
+		OperationNameKey:  OperationPrefixUpdate + "1",
+		ReleaseLabel:      releaseNameForInstance("updated"),
+		UpdatePlanKey:     "large",
+		UpdateParamsKey:   `{"image":"nginx"}`,
+	})
+	releases.InstallRelease(nginx, releaseNameForInstance("updated"), "apps", []byte("{image: nginx, replicas: 2}"), false)
+
+	// Including those of instances whose plan is no longer offered, unless
+	// they change it
+	instance("retired", map[string]string{
+		OperationStateKey: string(osb.StateInProgress),
+		OperationNameKey:  OperationPrefixUpdate + "2",
+		ReleaseLabel:      releaseNameForInstance("retired"),
+		PlanKey:           "medium",
+		ChartVersionKey:   "1.0.0",
+		UpdatePlanKey:     "medium",
+		UpdateParamsKey:   `{"image":"nginx"}`,
+	})
+	releases.InstallRelease(nginx, releaseNameForInstance("retired"), "apps", []byte("{image: nginx, replicas: 3}"), false)
+	instance("replanned", map[string]string{
+		OperationStateKey: string(osb.StateInProgress),
+		OperationNameKey:  OperationPrefixUpdate + "3",
+		ReleaseLabel:      releaseNameForInstance("replanned"),
+		PlanKey:           "medium",
+		UpdatePlanKey:     "xlarge",
+		UpdateParamsKey:   `{"image":"nginx"}`,
+	})
+	releases.InstallRelease(nginx, releaseNameForInstance("replanned"), "apps", []byte("{image: nginx, replicas: 3}"), false)
+
+	// Deprovisions delete the bindings left behind
+	instance("deprovisioned", map[string]string{
+		OperationStateKey: string(osb.StateInProgress),
+		OperationNameKey:  OperationPrefixDeprovision + "1",
+		ReleaseLabel:      releaseNameForInstance("deprovisioned"),
+	})
+	binding("deprovisioned", "leftover", map[string][]byte{})
+
+	// Binds are resumed
+	instance("ready", map[string]string{ReleaseLabel: releaseNameForInstance("ready")})
+	binding("ready", "bound", map[string][]byte{
+		OperationStateKey: []byte(osb.StateInProgress),
+		OperationNameKey:  []byte(OperationPrefixBind + "1"),
+	})
+	api.add("services", &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "apps", Labels: map[string]string{InstanceLabel: "ready"}},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}},
+	})
+	api.add("secrets", &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "apps", Labels: map[string]string{InstanceLabel: "ready"}},
+		Data:       map[string][]byte{"password": []byte("secret")},
+	})
+
+	locks := &fakeOperationLocks{held: map[string]bool{}}
+	recovering, err := c.recoverOperations(locks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovering.Wait()
+
+	expectedStates := map[string]osb.LastOperationState{
+		"provisioned": osb.StateSucceeded,
+		"interrupted": osb.StateFailed,
+		"updated":     osb.StateSucceeded,
+		"retired":     osb.StateSucceeded,
+		"replanned":   osb.StateFailed,
+	}
+	for instanceID, expected := range expectedStates {
+		config := api.get("configmaps", "minibroker", instanceID).(*corev1.ConfigMap)
+		if state := config.Data[OperationStateKey]; state != string(expected) {
+			t.Errorf("instance %s: expected state %s, actual %s (%s)", instanceID, expected, state, config.Data[OperationDescriptionKey])
+		}
+	}
+	if updated := api.get("configmaps", "minibroker", "updated").(*corev1.ConfigMap); updated.Labels[PlanKey] != "large" {
+		t.Errorf("instance updated: expected plan large, actual %s", updated.Labels[PlanKey])
+	}
+	if retired := api.get("configmaps", "minibroker", "retired").(*corev1.ConfigMap); retired.Data[ProvisionParamsKey] != `{"image":"nginx"}` {
+		t.Errorf("instance retired: expected the parameters to be updated, actual %s", retired.Data[ProvisionParamsKey])
+	}
+	if api.get("configmaps", "minibroker", "deprovisioned") != nil || api.get("secrets", "minibroker", "leftover") != nil {
+		t.Errorf("instance deprovisioned: expected the instance and its binding to be deleted")
+	}
+
+	bound := api.get("secrets", "minibroker", "bound").(*corev1.Secret)
+	if state := string(bound.Data[OperationStateKey]); state != string(osb.StateSucceeded) {
+		t.Errorf("binding bound: expected state %s, actual %s (%s)", osb.StateSucceeded, state, bound.Data[OperationDescriptionKey])
+	}
+	var creds map[string]interface{}
+	if err := json.Unmarshal(bound.Data[BindingCredentialsKey], &creds); err != nil || creds["password"] != "secret" {
+		t.Errorf("binding bound: expected the chart credentials, actual %s", bound.Data[BindingCredentialsKey])
+	}
+
+	if len(locks.locked) != 7 {
+		t.Errorf("expected the 6 instances and the binding to be locked, actual %v", locks.locked)
+	}
+	if len(locks.held) != 0 {
+		t.Errorf("expected every lock to be released, still held: %v", locks.held)
+	}
+}
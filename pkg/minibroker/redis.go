@@ -1,6 +1,9 @@
 package minibroker
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 )
@@ -43,3 +46,60 @@ func (p RedisProvider) Bind(services []corev1.Service, params map[string]interfa
 
 	return &creds, nil
 }
+
+// CreateUser relies on the ACLs introduced in Redis 6; older servers report
+// ErrUserNotSupported so that the chart password is shared instead.
+func (p RedisProvider) CreateUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user, password string) (*Credentials, error) {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := runner.Run(
+		redisCommand(*creds),
+		map[string]string{"REDISCLI_AUTH": "redis-password"},
+		fmt.Sprintf("ACL SETUSER %s reset on >%s ~* +@all\n", user, password))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create user %s", user)
+	}
+	output = strings.TrimSpace(output)
+	if strings.Contains(output, "unknown command") {
+		return nil, ErrUserNotSupported
+	}
+	if output != "OK" {
+		return nil, errors.Errorf("could not create user %s: %s", user, output)
+	}
+
+	creds.Username = user
+	creds.Password = password
+	creds.URI = buildURI(*creds)
+	return creds, nil
+}
+
+func (p RedisProvider) DropUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user string) error {
+	creds, err := p.Bind(services, params, chartSecrets)
+	if err != nil {
+		return err
+	}
+
+	output, err := runner.Run(
+		redisCommand(*creds),
+		map[string]string{"REDISCLI_AUTH": "redis-password"},
+		fmt.Sprintf("ACL DELUSER %s\n", user))
+	if err != nil {
+		return errors.Wrapf(err, "could not drop user %s", user)
+	}
+	if strings.HasPrefix(strings.TrimSpace(output), "ERR") {
+		return errors.Errorf("could not drop user %s: %s", user, output)
+	}
+	return nil
+}
+
+// redisCommand runs the commands of the command script, which redis-cli only
+// reads from its standard input.
+func redisCommand(creds Credentials) []string {
+	return []string{
+		"sh", "-c", `exec redis-cli -h "$0" -p "$1" < ` + commandScriptPath,
+		creds.Host, fmt.Sprintf("%d", creds.Port),
+	}
+}
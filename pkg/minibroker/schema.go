@@ -0,0 +1,394 @@
+package minibroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+const (
+	jsonSchemaVersion = "http://json-schema.org/draft-04/schema#"
+	valuesSchemaFile  = "values.schema.json"
+)
+
+// ParameterProvider is implemented by providers that read the parameters of
+// an instance or binding to compute its credentials.
+type ParameterProvider interface {
+	// Parameters returns the JSON schema properties of those parameters.
+	Parameters() map[string]interface{}
+}
+
+var (
+	_ ParameterProvider = MySQLProvider{}
+	_ ParameterProvider = MariadbProvider{}
+	_ ParameterProvider = PostgresProvider{}
+	_ ParameterProvider = MongodbProvider{}
+)
+
+func stringParameter(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"description": description,
+	}
+}
+
+// planSchemas holds the JSON schemas of the parameters of a plan.
+type planSchemas struct {
+	provision map[string]interface{}
+	bind      map[string]interface{}
+	// values is the values.schema.json of the chart, nil when it has none
+	values map[string]interface{}
+}
+
+func (s *planSchemas) parameterSchemas() *osb.ParameterSchemas {
+	return &osb.ParameterSchemas{
+		ServiceInstances: &osb.ServiceInstanceSchema{
+			Create: &osb.InputParameters{Parameters: s.provision},
+			Update: &osb.InputParameters{Parameters: s.provision},
+		},
+		ServiceBindings: &osb.ServiceBindingSchema{
+			Create: &osb.InputParameters{Parameters: s.bind},
+		},
+	}
+}
+
+// schemaCache keeps the schemas of the charts that were already downloaded,
+// by service and chart version.
+type schemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]*planSchemas
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{schemas: map[string]*planSchemas{}}
+}
+
+func schemaKey(serviceID, chartVersion string) string {
+	return serviceID + "@" + chartVersion
+}
+
+func (c *schemaCache) get(key string) *planSchemas {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.schemas[key]
+}
+
+func (c *schemaCache) set(key string, schemas *planSchemas) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schemas[key] = schemas
+}
+
+// catalogSchemas returns the schemas to advertise for a plan. Until its chart
+// has been downloaded to install an instance, only the parameters known to
+// the provider are described, as downloading every chart of the catalog
+// would be too costly.
+func (c *Client) catalogSchemas(serviceID, chartVersion string) *osb.ParameterSchemas {
+	if schemas := c.schemas.get(schemaKey(serviceID, chartVersion)); schemas != nil {
+		return schemas.parameterSchemas()
+	}
+	return c.buildSchemas(serviceID, nil).parameterSchemas()
+}
+
+// chartSchemas returns the schemas of the plans installing the given chart
+// version, building them from the chart the first time. Charts whose values
+// schema cannot be parsed are cached without it.
+func (c *Client) chartSchemas(serviceID, chartVersion string, ch *chart.Chart) *planSchemas {
+	key := schemaKey(serviceID, chartVersion)
+	if schemas := c.schemas.get(key); schemas != nil {
+		return schemas
+	}
+	schemas := c.buildSchemas(serviceID, ch)
+	c.schemas.set(key, schemas)
+	return schemas
+}
+
+// buildSchemas combines the schema of the chart values, if given, with the
+// parameters known to the provider of the service.
+func (c *Client) buildSchemas(serviceID string, ch *chart.Chart) *planSchemas {
+	provision := map[string]interface{}{"type": "object"}
+	var values map[string]interface{}
+	if ch != nil {
+		chartSchema, err := valuesSchema(ch)
+		if err != nil {
+			glog.Errorf("Ignoring the values schema of %s: %s", serviceID, err)
+		} else {
+			provision = chartSchema
+			// Parsed again so that it is not extended with the parameters
+			// of the provider
+			values, _ = chartValuesSchema(ch)
+		}
+	}
+	provision["$schema"] = jsonSchemaVersion
+
+	bind := map[string]interface{}{
+		"$schema": jsonSchemaVersion,
+		"type":    "object",
+	}
+
+	if provider, ok := c.providers[c.helm.ChartName(serviceID)].(ParameterProvider); ok {
+		parameters := provider.Parameters()
+		properties, ok := provision["properties"].(map[string]interface{})
+		if !ok {
+			properties = map[string]interface{}{}
+			provision["properties"] = properties
+		}
+		for name, schema := range parameters {
+			properties[name] = schema
+		}
+		bind["properties"] = parameters
+	}
+
+	return &planSchemas{provision: provision, bind: bind, values: values}
+}
+
+// chartValuesSchema returns the values.schema.json of a chart, or nil when it
+// has none.
+func chartValuesSchema(ch *chart.Chart) (map[string]interface{}, error) {
+	for _, f := range ch.GetFiles() {
+		if f.GetTypeUrl() == valuesSchemaFile {
+			var schema map[string]interface{}
+			if err := json.Unmarshal(f.GetValue(), &schema); err != nil {
+				return nil, errors.Wrapf(err, "could not parse %s", valuesSchemaFile)
+			}
+			return schema, nil
+		}
+	}
+	return nil, nil
+}
+
+// valuesSchema returns the values.schema.json of a chart, or a schema
+// inferred from its default values when it has none.
+func valuesSchema(ch *chart.Chart) (map[string]interface{}, error) {
+	schema, err := chartValuesSchema(ch)
+	if err != nil || schema != nil {
+		return schema, err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal([]byte(ch.GetValues().GetRaw()), &values); err != nil {
+		return nil, errors.Wrap(err, "could not parse the chart values")
+	}
+	return inferSchema(values), nil
+}
+
+// inferSchema returns a schema accepting values of the same type as the
+// given default. Objects accept properties beyond the known ones.
+func inferSchema(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties := make(map[string]interface{}, len(v))
+		for name, property := range v {
+			properties[name] = inferSchema(property)
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+	case []interface{}:
+		return map[string]interface{}{"type": "array"}
+	case string:
+		return map[string]interface{}{"type": "string", "default": v}
+	case bool:
+		return map[string]interface{}{"type": "boolean", "default": v}
+	case float64:
+		// Not "integer", as a default of 1 does not mean 0.5 is invalid
+		return map[string]interface{}{"type": "number", "default": v}
+	}
+	// Null defaults accept anything
+	return map[string]interface{}{}
+}
+
+// validate checks the parameters of an instance against the
+// values.schema.json of the chart, when it has one. Schemas inferred from the
+// default values are only advertised, as charts accept more than their
+// defaults show.
+func (s *planSchemas) validate(params map[string]interface{}) error {
+	if s.values == nil {
+		return nil
+	}
+	return validateParameters(s.values, params)
+}
+
+// validateParameters checks the parameters of a request against a schema,
+// returning a 400 error listing the violations.
+func validateParameters(schema map[string]interface{}, params map[string]interface{}) error {
+	var value interface{} = params
+	if params == nil {
+		value = map[string]interface{}{}
+	}
+	violations := validateSchema(schema, value, "")
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Strings(violations)
+	msg := "invalid parameters: " + strings.Join(violations, "; ")
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &msg,
+	}
+}
+
+// validateSchema checks value against the keywords of JSON schema that
+// describe types, objects, arrays, strings and numbers. Other keywords are
+// ignored.
+func validateSchema(schema map[string]interface{}, value interface{}, path string) []string {
+	name := path
+	if name == "" {
+		name = "parameters"
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		matches := false
+		for _, t := range types {
+			if typeMatches(t, value) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return []string{fmt.Sprintf("%s: expected %s, got %s", name, strings.Join(types, " or "), jsonType(value))}
+		}
+	}
+
+	var violations []string
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("%s: must be one of %v", name, enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		for property, propertyValue := range v {
+			propertyPath := property
+			if path != "" {
+				propertyPath = path + "." + property
+			}
+			if propertySchema, ok := properties[property].(map[string]interface{}); ok {
+				violations = append(violations, validateSchema(propertySchema, propertyValue, propertyPath)...)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					violations = append(violations, fmt.Sprintf("%s: unknown parameter", propertyPath))
+				}
+			case map[string]interface{}:
+				violations = append(violations, validateSchema(additional, propertyValue, propertyPath)...)
+			}
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, property := range required {
+				if propertyName, ok := property.(string); ok {
+					if _, ok := v[propertyName]; !ok {
+						violations = append(violations, fmt.Sprintf("%s: missing required parameter %q", name, propertyName))
+					}
+				}
+			}
+		}
+	case []interface{}:
+		if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < min {
+			violations = append(violations, fmt.Sprintf("%s: must have at least %v items", name, min))
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > max {
+			violations = append(violations, fmt.Sprintf("%s: must have at most %v items", name, max))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				violations = append(violations, validateSchema(items, item, fmt.Sprintf("%s[%d]", name, i))...)
+			}
+		}
+	case string:
+		if min, ok := schemaNumber(schema, "minLength"); ok && float64(len(v)) < min {
+			violations = append(violations, fmt.Sprintf("%s: must be at least %v characters long", name, min))
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && float64(len(v)) > max {
+			violations = append(violations, fmt.Sprintf("%s: must be at most %v characters long", name, max))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				violations = append(violations, fmt.Sprintf("%s: must match %q", name, pattern))
+			}
+		}
+	case float64:
+		if min, ok := schemaNumber(schema, "minimum"); ok && v < min {
+			violations = append(violations, fmt.Sprintf("%s: must be at least %v", name, min))
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok && v > max {
+			violations = append(violations, fmt.Sprintf("%s: must be at most %v", name, max))
+		}
+	}
+	return violations
+}
+
+func schemaTypes(t interface{}) []string {
+	switch v := t.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		types := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := schema[keyword].(float64)
+	return n, ok
+}
+
+func typeMatches(t string, value interface{}) bool {
+	switch t {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	}
+	return jsonType(value) == t
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,238 @@
+package minibroker
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	commandPollInterval = 2 * time.Second
+	commandTimeout      = 5 * time.Minute
+)
+
+// ErrUserNotSupported is returned by a UserProvider when the deployed release
+// is not able to manage users, e.g. because the server version is too old.
+var ErrUserNotSupported = errors.New("the release does not support creating users")
+
+// UserProvider is implemented by providers that can create a dedicated user
+// for every binding instead of handing out the chart credentials.
+type UserProvider interface {
+	// CreateUser creates the user with the given password and returns the
+	// credentials for it. It must succeed when the user already exists.
+	CreateUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user, password string) (*Credentials, error)
+	// DropUser deletes the user. It must succeed when the user is missing.
+	DropUser(runner CommandRunner, services []corev1.Service, params map[string]interface{}, chartSecrets map[string]interface{}, user string) error
+}
+
+var (
+	_ UserProvider = MySQLProvider{}
+	_ UserProvider = MariadbProvider{}
+	_ UserProvider = PostgresProvider{}
+	_ UserProvider = MongodbProvider{}
+	_ UserProvider = RedisProvider{}
+)
+
+// commandScriptPath is where the script of a command is mounted.
+const commandScriptPath = "/minibroker/script"
+
+// CommandRunner runs a command next to a release and returns its output.
+//
+// Commands handle credentials, which must not appear in their arguments nor in
+// the pod running them: secretEnv maps environment variables to the keys of
+// the chart secrets holding their values, and script, which may hold the
+// credentials of a new user, is mounted from a short-lived secret at
+// commandScriptPath.
+type CommandRunner interface {
+	Run(command []string, secretEnv map[string]string, script string) (string, error)
+}
+
+// podRunner runs commands in a short-lived pod using the image of the release.
+type podRunner struct {
+	coreClient kubernetes.Interface
+	namespace  string
+	image      string
+	// secretNames are the names of the chart secrets holding each key
+	secretNames map[string]string
+}
+
+// newCommandRunner returns a CommandRunner using the image of the pods
+// backing the first service of a release.
+func (c *Client) newCommandRunner(resources *releaseResources) (CommandRunner, error) {
+	service := resources.services[0]
+	pods, err := c.coreClient.CoreV1().Pods(service.Namespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(service.Spec.Selector).String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list pods for service %s/%s", service.Namespace, service.Name)
+	}
+	for _, pod := range pods.Items {
+		for _, container := range pod.Spec.Containers {
+			return podRunner{
+				coreClient:  c.coreClient,
+				namespace:   service.Namespace,
+				image:       container.Image,
+				secretNames: resources.secretNames,
+			}, nil
+		}
+	}
+	return nil, errors.Errorf("no pods found for service %s/%s", service.Namespace, service.Name)
+}
+
+func (r podRunner) Run(command []string, secretEnv map[string]string, script string) (string, error) {
+	container := corev1.Container{
+		Name:    "command",
+		Image:   r.image,
+		Command: command,
+	}
+	for name, key := range secretEnv {
+		secretName, ok := r.secretNames[key]
+		if !ok {
+			return "", errors.Errorf("%s not found in secret keys", key)
+		}
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+					Key:                  key,
+				},
+			},
+		})
+	}
+
+	secretInterface := r.coreClient.CoreV1().Secrets(r.namespace)
+	scriptSecret, err := secretInterface.Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "minibroker-command-",
+			Namespace:    r.namespace,
+			Labels:       map[string]string{HeritageLabel: "minibroker"},
+		},
+		Data: map[string][]byte{path.Base(commandScriptPath): []byte(script)},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create secret to run %q", command[0])
+	}
+	defer func() {
+		if err := secretInterface.Delete(scriptSecret.Name, &metav1.DeleteOptions{}); err != nil {
+			glog.Errorf("could not delete secret %s/%s: %s", r.namespace, scriptSecret.Name, err)
+		}
+	}()
+	container.VolumeMounts = []corev1.VolumeMount{{
+		Name:      "script",
+		MountPath: path.Dir(commandScriptPath),
+		ReadOnly:  true,
+	}}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "minibroker-command-",
+			Namespace:    r.namespace,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers:    []corev1.Container{container},
+			Volumes: []corev1.Volume{{
+				Name: "script",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: scriptSecret.Name},
+				},
+			}},
+		},
+	}
+
+	podInterface := r.coreClient.CoreV1().Pods(r.namespace)
+	created, err := podInterface.Create(&pod)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create pod to run %q", command[0])
+	}
+	defer func() {
+		if err := podInterface.Delete(created.Name, &metav1.DeleteOptions{}); err != nil {
+			glog.Errorf("could not delete pod %s/%s: %s", r.namespace, created.Name, err)
+		}
+	}()
+
+	var phase corev1.PodPhase
+	err = wait.PollImmediate(commandPollInterval, commandTimeout, func() (bool, error) {
+		current, err := podInterface.Get(created.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		phase = current.Status.Phase
+		return phase == corev1.PodSucceeded || phase == corev1.PodFailed, nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed waiting for %q to complete in pod %s/%s", command[0], r.namespace, created.Name)
+	}
+
+	output, err := podInterface.GetLogs(created.Name, &corev1.PodLogOptions{}).Do().Raw()
+	if err != nil {
+		return "", errors.Wrapf(err, "could not get output of pod %s/%s", r.namespace, created.Name)
+	}
+	if phase == corev1.PodFailed {
+		return string(output), errors.Errorf("%q failed: %s", command[0], output)
+	}
+	return string(output), nil
+}
+
+// generateUsername returns a stable user name for a binding, short enough to
+// be accepted by all of the supported databases.
+func generateUsername(bindingID string) string {
+	sum := sha1.Sum([]byte(bindingID))
+	return "mb" + hex.EncodeToString(sum[:])[:14]
+}
+
+func generatePassword() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "could not generate password")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// createBindingUser creates (or re-creates) the user recorded in the binding
+// secret.
+func (c *Client) createBindingUser(provider UserProvider, secret *corev1.Secret, resources *releaseResources) (*Credentials, error) {
+	runner, err := c.newCommandRunner(resources)
+	if err != nil {
+		return nil, err
+	}
+
+	user := string(secret.Data[BindingUsernameKey])
+	password := string(secret.Data[BindingPasswordKey])
+	glog.Infof("Creating user %q for binding %q", user, secret.Name)
+	return provider.CreateUser(runner, resources.services, resources.params, resources.secrets, user, password)
+}
+
+// dropBindingUser deletes the user recorded in the binding secret, if any.
+func (c *Client) dropBindingUser(provider UserProvider, secret *corev1.Secret, resources *releaseResources) error {
+	user, ok := secret.Data[BindingUsernameKey]
+	if !ok {
+		return nil
+	}
+
+	runner, err := c.newCommandRunner(resources)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Dropping user %q of binding %q", user, secret.Name)
+	return provider.DropUser(runner, resources.services, resources.params, resources.secrets, string(user))
+}
+
+// jsString quotes a value so it can be embedded in a JavaScript or JSON
+// document.
+func jsString(value string) string {
+	return fmt.Sprintf("%q", value)
+}